@@ -22,13 +22,28 @@ type Executor interface {
 	ExecuteClusterCommand(scope int, commandMap map[int][]string) *RemoteOutput
 }
 
+/*
+ * The Executor of a cluster must also implement FileExecutor to run commands
+ * with the WithOutputDirectory option; GPDBExecutor and TestExecutor both do.
+ */
+type FileExecutor interface {
+	ExecuteClusterCommandToFiles(scope int, commandMap map[int][]string, outputFiles map[int]OutputFile) *RemoteOutput
+}
+
 // This type only exists to allow us to mock Execute[...]Command functions for testing
 type GPDBExecutor struct{}
 
+/*
+ * SSHUser and SSHOptions are optional; if SSHUser is empty, commands are run
+ * over ssh as the current user, and any SSHOptions (e.g. "-p", "2222") are
+ * passed to ssh before the destination host.
+ */
 type Cluster struct {
 	ContentIDs []int
 	Segments   map[int]SegConfig
 	Executor
+	SSHUser    string
+	SSHOptions []string
 }
 
 type SegConfig struct {
@@ -64,13 +79,56 @@ const (
 	ON_MASTER_TO_HOSTS_AND_MASTER
 )
 
+/*
+ * Options that can be passed to GenerateAndExecuteCommand and the
+ * Generate...CommandMapFor... functions to change which segments or hosts are
+ * targeted (see SegmentSelector) or how each command is run (see RunAs).
+ * WithOutputDirectory only affects GenerateAndExecuteCommand, as the
+ * Generate...CommandMapFor... functions do not execute commands, and
+ * SelectClusters only affects MultiCluster.GenerateAndExecuteCommand.
+ */
+type CommandOption interface {
+	applyTo(options *commandOptions)
+}
+
+type commandOptions struct {
+	selectors    []SegmentSelector
+	runAs        *RunAs
+	outputDir    string
+	clusterNames []string
+}
+
+func newCommandOptions(options []CommandOption) *commandOptions {
+	opts := &commandOptions{}
+	for _, option := range options {
+		if option != nil {
+			option.applyTo(opts)
+		}
+	}
+	return opts
+}
+
+/*
+ * Applies any run-as option to the generated command string, so that it can be
+ * run either locally or over ssh as usual.
+ */
+func (opts *commandOptions) wrapCommand(generateCommand func(int) string) func(int) string {
+	if opts.runAs == nil {
+		return generateCommand
+	}
+	return func(contentID int) string {
+		return opts.runAs.WrapCommand(generateCommand(contentID))
+	}
+}
+
 type RemoteOutput struct {
-	Scope     int
-	NumErrors int
-	Stdouts   map[int]string
-	Stderrs   map[int]string
-	Errors    map[int]error
-	CmdStrs   map[int]string
+	Scope       int
+	NumErrors   int
+	Stdouts     map[int]string
+	Stderrs     map[int]string
+	Errors      map[int]error
+	CmdStrs     map[int]string
+	OutputFiles map[int]OutputFile
 }
 
 /*
@@ -93,12 +151,14 @@ func (cluster *Cluster) GenerateSegmentSSHCommand(contentID int, generateCommand
 	if contentID == -1 {
 		return []string{"bash", "-c", cmdStr}
 	}
-	return ConstructSSHCommand(cluster.GetHostForContent(contentID), cmdStr)
+	return cluster.constructSSHCommand(cluster.GetHostForContent(contentID), cmdStr)
 }
 
-func (cluster *Cluster) GenerateSSHCommandMapForSegments(includeMaster bool, generateCommand func(int) string) map[int][]string {
+func (cluster *Cluster) GenerateSSHCommandMapForSegments(includeMaster bool, generateCommand func(int) string, options ...CommandOption) map[int][]string {
+	opts := newCommandOptions(options)
+	generateCommand = opts.wrapCommand(generateCommand)
 	commandMap := make(map[int][]string, len(cluster.ContentIDs))
-	for _, contentID := range cluster.ContentIDs {
+	for _, contentID := range cluster.GetContentsMatching(opts.selectors...) {
 		if contentID == -1 && !includeMaster {
 			continue
 		}
@@ -107,19 +167,15 @@ func (cluster *Cluster) GenerateSSHCommandMapForSegments(includeMaster bool, gen
 	return commandMap
 }
 
-func (cluster *Cluster) GenerateSSHCommandMapForHosts(includeMaster bool, generateCommand func(int) string) map[int][]string {
+func (cluster *Cluster) GenerateSSHCommandMapForHosts(includeMaster bool, generateCommand func(int) string, options ...CommandOption) map[int][]string {
+	opts := newCommandOptions(options)
+	generateCommand = opts.wrapCommand(generateCommand)
 	/*
 	 * Derive a list of unique hosts from the cluster and then generate commands
 	 * for each.  If includeMaster is false but there are segments on the master
 	 * host, such as for a single-node cluster, the master host will be included.
 	 */
-	hostSegMap := make(map[string]int, 0)
-	for contentID, seg := range cluster.Segments {
-		if contentID == -1 && !includeMaster {
-			continue
-		}
-		hostSegMap[seg.Hostname] = contentID
-	}
+	hostSegMap := cluster.getHostSegMap(includeMaster, opts.selectors...)
 	commands := make(map[int][]string, 0)
 	for _, contentID := range hostSegMap {
 		commands[contentID] = cluster.GenerateSegmentSSHCommand(contentID, generateCommand)
@@ -127,9 +183,11 @@ func (cluster *Cluster) GenerateSSHCommandMapForHosts(includeMaster bool, genera
 	return commands
 }
 
-func (cluster *Cluster) GenerateLocalCommandMapForSegments(includeMaster bool, generateCommand func(int) string) map[int][]string {
+func (cluster *Cluster) GenerateLocalCommandMapForSegments(includeMaster bool, generateCommand func(int) string, options ...CommandOption) map[int][]string {
+	opts := newCommandOptions(options)
+	generateCommand = opts.wrapCommand(generateCommand)
 	commandMap := make(map[int][]string, len(cluster.ContentIDs))
-	for _, contentID := range cluster.ContentIDs {
+	for _, contentID := range cluster.GetContentsMatching(opts.selectors...) {
 		if contentID == -1 && !includeMaster {
 			continue
 		}
@@ -139,20 +197,35 @@ func (cluster *Cluster) GenerateLocalCommandMapForSegments(includeMaster bool, g
 	return commandMap
 }
 
-func (cluster *Cluster) GenerateLocalCommandMapForHosts(includeMaster bool, generateCommand func(int) string) map[int][]string {
+func (cluster *Cluster) GenerateLocalCommandMapForHosts(includeMaster bool, generateCommand func(int) string, options ...CommandOption) map[int][]string {
+	opts := newCommandOptions(options)
+	generateCommand = opts.wrapCommand(generateCommand)
+	hostSegMap := cluster.getHostSegMap(includeMaster, opts.selectors...)
+	commands := make(map[int][]string, 0)
+	for _, contentID := range hostSegMap {
+		cmdStr := generateCommand(contentID)
+		commands[contentID] = []string{"bash", "-c", cmdStr}
+	}
+	return commands
+}
+
+/*
+ * Maps each unique hostname among the selected segments to one of the content
+ * IDs on that host, which is then used to generate the command for the host.
+ */
+func (cluster *Cluster) getHostSegMap(includeMaster bool, selectors ...SegmentSelector) map[string]int {
+	matches := matchAll(selectors)
 	hostSegMap := make(map[string]int, 0)
 	for contentID, seg := range cluster.Segments {
 		if contentID == -1 && !includeMaster {
 			continue
 		}
+		if !matches(seg) {
+			continue
+		}
 		hostSegMap[seg.Hostname] = contentID
 	}
-	commands := make(map[int][]string, 0)
-	for _, contentID := range hostSegMap {
-		cmdStr := generateCommand(contentID)
-		commands[contentID] = []string{"bash", "-c", cmdStr}
-	}
-	return commands
+	return hostSegMap
 }
 
 func (executor *GPDBExecutor) ExecuteLocalCommand(commandStr string) (string, error) {
@@ -214,34 +287,70 @@ func (executor *GPDBExecutor) ExecuteClusterCommand(scope int, commandMap map[in
  *    - e.g. running an ls on all hosts
  * 2. shell commands on master to push to remote hosts.
  *    - e.g. running multiple scps on master to push a file to all segments
+ *
+ * Any selectors passed to GenerateAndExecuteCommand narrow the segments or
+ * hosts targeted within the given scope, and a RunAs option runs each command
+ * as another user; see SegmentSelector and RunAs for details.
  */
-func (cluster *Cluster) GenerateAndExecuteCommand(verboseMsg string, execFunc func(contentID int) string, scope int) *RemoteOutput {
+func (cluster *Cluster) GenerateAndExecuteCommand(verboseMsg string, execFunc func(contentID int) string, scope int, options ...CommandOption) *RemoteOutput {
 	gplog.Verbose(verboseMsg)
+	opts := newCommandOptions(options)
+	commandMap := cluster.generateCommandMap(verboseMsg, execFunc, scope, options...)
+	cluster.checkExecutor(verboseMsg, opts)
+	return cluster.executeCommandMap(scope, commandMap, opts)
+}
+
+/*
+ * Checks that the cluster's Executor supports the given options before any
+ * command is run, so that executeCommandMap does not need to fail and can be
+ * called from another goroutine.
+ */
+func (cluster *Cluster) checkExecutor(verboseMsg string, opts *commandOptions) {
+	if _, ok := cluster.Executor.(FileExecutor); opts.outputDir != "" && !ok {
+		// If we ever get to this case, it's programmer error, not user error.
+		gplog.Fatal(fmt.Errorf("Cannot write output of command to %s to files; executor of type %T does not implement FileExecutor", strings.ToLower(verboseMsg), cluster.Executor), "")
+	}
+}
+
+func (cluster *Cluster) executeCommandMap(scope int, commandMap map[int][]string, opts *commandOptions) *RemoteOutput {
+	var output *RemoteOutput
+	if opts.outputDir != "" {
+		outputFiles := cluster.GetOutputFiles(opts.outputDir, scope, commandMap)
+		output = cluster.Executor.(FileExecutor).ExecuteClusterCommandToFiles(scope, commandMap, outputFiles)
+	} else {
+		output = cluster.ExecuteClusterCommand(scope, commandMap)
+	}
+	if opts.runAs != nil {
+		opts.runAs.annotateErrors(output)
+	}
+	return output
+}
+
+func (cluster *Cluster) generateCommandMap(verboseMsg string, execFunc func(contentID int) string, scope int, options ...CommandOption) map[int][]string {
 	var commandMap map[int][]string
 	switch scope {
 	case ON_SEGMENTS:
-		commandMap = cluster.GenerateSSHCommandMapForSegments(false, execFunc)
+		commandMap = cluster.GenerateSSHCommandMapForSegments(false, execFunc, options...)
 	case ON_SEGMENTS_AND_MASTER:
-		commandMap = cluster.GenerateSSHCommandMapForSegments(true, execFunc)
+		commandMap = cluster.GenerateSSHCommandMapForSegments(true, execFunc, options...)
 	case ON_HOSTS:
-		commandMap = cluster.GenerateSSHCommandMapForHosts(false, execFunc)
+		commandMap = cluster.GenerateSSHCommandMapForHosts(false, execFunc, options...)
 	case ON_HOSTS_AND_MASTER:
-		commandMap = cluster.GenerateSSHCommandMapForHosts(true, execFunc)
+		commandMap = cluster.GenerateSSHCommandMapForHosts(true, execFunc, options...)
 
 	case ON_MASTER_TO_SEGMENTS:
-		commandMap = cluster.GenerateLocalCommandMapForSegments(false, execFunc)
+		commandMap = cluster.GenerateLocalCommandMapForSegments(false, execFunc, options...)
 	case ON_MASTER_TO_SEGMENTS_AND_MASTER:
-		commandMap = cluster.GenerateLocalCommandMapForSegments(true, execFunc)
+		commandMap = cluster.GenerateLocalCommandMapForSegments(true, execFunc, options...)
 	case ON_MASTER_TO_HOSTS:
-		commandMap = cluster.GenerateLocalCommandMapForHosts(false, execFunc)
+		commandMap = cluster.GenerateLocalCommandMapForHosts(false, execFunc, options...)
 	case ON_MASTER_TO_HOSTS_AND_MASTER:
-		commandMap = cluster.GenerateLocalCommandMapForHosts(true, execFunc)
+		commandMap = cluster.GenerateLocalCommandMapForHosts(true, execFunc, options...)
 	default:
 		// If we ever get to this case, it's programmer error, not user error.
 		gplog.Fatal(fmt.Errorf("Invalid remote execution scope for command to %s: %d", strings.ToLower(verboseMsg), scope), "")
 	}
-
-	return cluster.ExecuteClusterCommand(scope, commandMap)
+	return commandMap
 }
 
 func (cluster *Cluster) CheckClusterError(remoteOutput *RemoteOutput, finalErrMsg string, messageFunc func(contentID int) string, noFatal ...bool) {
@@ -251,22 +360,8 @@ func (cluster *Cluster) CheckClusterError(remoteOutput *RemoteOutput, finalErrMs
 
 	for contentID, err := range remoteOutput.Errors {
 		if err != nil {
-			var dest string
-			hostname := cluster.GetHostForContent(contentID)
-			s := remoteOutput.Scope
-			switch {
-			case s == ON_SEGMENTS || s == ON_SEGMENTS_AND_MASTER:
-				dest += fmt.Sprintf("on segment %d ", contentID)
-				dest += fmt.Sprintf("on host %s", hostname)
-			case s == ON_HOSTS || s == ON_HOSTS_AND_MASTER:
-				dest += fmt.Sprintf("on host %s", hostname)
-			case s == ON_MASTER_TO_SEGMENTS || s == ON_MASTER_TO_SEGMENTS_AND_MASTER:
-				dest += fmt.Sprintf("on master for segment %d ", contentID)
-				dest += fmt.Sprintf("on host %s", hostname)
-			case s == ON_MASTER_TO_HOSTS || s == ON_MASTER_TO_HOSTS_AND_MASTER:
-				dest += fmt.Sprintf("on master for host %s", hostname)
-			}
-			gplog.Verbose("%s %s with error %s: %s", messageFunc(contentID), dest, err, remoteOutput.Stderrs[contentID])
+			dest := cluster.describeDestination(remoteOutput.Scope, contentID)
+			gplog.Verbose("%s %s with error %s: %s", messageFunc(contentID), dest, err, remoteOutput.getStderr(contentID))
 			gplog.Verbose("Command was: %s", remoteOutput.CmdStrs[contentID])
 		}
 	}
@@ -277,7 +372,40 @@ func (cluster *Cluster) CheckClusterError(remoteOutput *RemoteOutput, finalErrMs
 	}
 }
 
+/*
+ * If the output of a command was written to files, point to the stderr file
+ * instead of logging its contents.
+ */
+func (output *RemoteOutput) getStderr(contentID int) string {
+	if outputFile, ok := output.OutputFiles[contentID]; ok {
+		return fmt.Sprintf("see %s", outputFile.StderrPath)
+	}
+	return output.Stderrs[contentID]
+}
+
+func (cluster *Cluster) describeDestination(scope int, contentID int) string {
+	var dest string
+	hostname := cluster.GetHostForContent(contentID)
+	switch {
+	case scope == ON_SEGMENTS || scope == ON_SEGMENTS_AND_MASTER:
+		dest += fmt.Sprintf("on segment %d ", contentID)
+		dest += fmt.Sprintf("on host %s", hostname)
+	case scope == ON_HOSTS || scope == ON_HOSTS_AND_MASTER:
+		dest += fmt.Sprintf("on host %s", hostname)
+	case scope == ON_MASTER_TO_SEGMENTS || scope == ON_MASTER_TO_SEGMENTS_AND_MASTER:
+		dest += fmt.Sprintf("on master for segment %d ", contentID)
+		dest += fmt.Sprintf("on host %s", hostname)
+	case scope == ON_MASTER_TO_HOSTS || scope == ON_MASTER_TO_HOSTS_AND_MASTER:
+		dest += fmt.Sprintf("on master for host %s", hostname)
+	}
+	return dest
+}
+
 func LogFatalClusterError(errMessage string, scope int, numErrors int) {
+	gplog.Fatal(errors.Errorf("%s. See %s for a complete list of errors.", summarizeClusterError(errMessage, scope, numErrors), gplog.GetLogFilePath()), "")
+}
+
+func summarizeClusterError(errMessage string, scope int, numErrors int) string {
 	str := " on"
 	if scope == ON_MASTER_TO_SEGMENTS || scope == ON_MASTER_TO_SEGMENTS_AND_MASTER || scope == ON_MASTER_TO_HOSTS || scope == ON_MASTER_TO_HOSTS_AND_MASTER {
 		str += " master for"
@@ -291,7 +419,7 @@ func LogFatalClusterError(errMessage string, scope int, numErrors int) {
 	if numErrors != 1 {
 		segMsg += "s"
 	}
-	gplog.Fatal(errors.Errorf("%s %d %s. See %s for a complete list of errors.", errMessage, numErrors, segMsg, gplog.GetLogFilePath()), "")
+	return fmt.Sprintf("%s %d %s", errMessage, numErrors, segMsg)
 }
 
 func (cluster *Cluster) GetContentList() []int {
@@ -320,7 +448,7 @@ func (cluster *Cluster) GetDirForContent(contentID int) string {
 
 func GetSegmentConfiguration(connection *dbconn.DBConn) ([]SegConfig, error) {
 	query := ""
-	if connection.Version.Before("6") {
+	if connection.Version.GPDBBefore("6") {
 		query = `
 SELECT
 	s.dbid,
@@ -360,6 +488,20 @@ func MustGetSegmentConfiguration(connection *dbconn.DBConn) []SegConfig {
 	return segConfigs
 }
 
+func (cluster *Cluster) constructSSHCommand(host string, cmd string) []string {
+	if cluster.SSHUser == "" && len(cluster.SSHOptions) == 0 {
+		return ConstructSSHCommand(host, cmd)
+	}
+	user := cluster.SSHUser
+	if user == "" {
+		currentUser, _ := operating.System.CurrentUser()
+		user = currentUser.Username
+	}
+	sshCmd := []string{"ssh", "-o", "StrictHostKeyChecking=no"}
+	sshCmd = append(sshCmd, cluster.SSHOptions...)
+	return append(sshCmd, fmt.Sprintf("%s@%s", user, host), cmd)
+}
+
 func ConstructSSHCommand(host string, cmd string) []string {
 	currentUser, _ := operating.System.CurrentUser()
 	user := currentUser.Username
@@ -108,6 +108,18 @@ var _ = Describe("cluster/cluster tests", func() {
 			Expect(results[2].DataDir).To(Equal("/data/gpseg2"))
 			Expect(results[2].Hostname).To(Equal("remotehost"))
 		})
+		It("queries pg_filespace_entry before GPDB 6", func() {
+			mock.ExpectQuery("FROM gp_segment_configuration s\\s+JOIN pg_filespace_entry").WillReturnRows(sqlmock.NewRows(header).AddRow(localSegOne...))
+			_, err := cluster.GetSegmentConfiguration(connection)
+			Expect(err).ToNot(HaveOccurred())
+		})
+		It("reads the data directory from gp_segment_configuration in Cloudberry", func() {
+			connection.Version, _ = dbconn.ParseVersion("PostgreSQL 14.4 (Apache Cloudberry 1.6.0 build 1)", "140004")
+			mock.ExpectQuery("datadir\\s+FROM gp_segment_configuration\\s+WHERE role = 'p'").WillReturnRows(sqlmock.NewRows(header).AddRow(localSegOne...))
+			results, err := cluster.GetSegmentConfiguration(connection)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results[0].DataDir).To(Equal("/data/gpseg0"))
+		})
 	})
 	Describe("GenerateSSHCommandMapForSegments", func() {
 		It("Returns a map of ssh commands for the master, including master", func() {
@@ -0,0 +1,262 @@
+package cluster
+
+/*
+ * This file contains structs and functions related to executing commands
+ * against several clusters at once, such as the source and destination
+ * clusters of a migration.
+ */
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/pkg/errors"
+)
+
+/*
+ * A MultiCluster groups named clusters, each of which keeps its own Executor
+ * and ssh settings and may have its own DBConn.  Names holds the cluster names
+ * in the order they were added, which is also the order in which clusters are
+ * listed in error messages.
+ */
+type MultiCluster struct {
+	Names       []string
+	Clusters    map[string]*Cluster
+	Connections map[string]*dbconn.DBConn
+}
+
+/*
+ * Results of a command run on multiple clusters are keyed by cluster name as
+ * well as content ID, as content IDs are only unique within a single cluster.
+ */
+type ClusterContentID struct {
+	ClusterName string
+	ContentID   int
+}
+
+func (id ClusterContentID) String() string {
+	return fmt.Sprintf("%s:%d", id.ClusterName, id.ContentID)
+}
+
+type MultiRemoteOutput struct {
+	Scope     int
+	NumErrors int
+	Stdouts   map[ClusterContentID]string
+	Stderrs   map[ClusterContentID]string
+	Errors    map[ClusterContentID]error
+	CmdStrs   map[ClusterContentID]string
+	Outputs   map[string]*RemoteOutput
+}
+
+func NewMultiCluster() *MultiCluster {
+	return &MultiCluster{
+		Names:       make([]string, 0),
+		Clusters:    make(map[string]*Cluster, 0),
+		Connections: make(map[string]*dbconn.DBConn, 0),
+	}
+}
+
+/*
+ * The connection may be nil if the cluster is only used to run commands.
+ */
+func (mc *MultiCluster) AddCluster(name string, cluster *Cluster, connection *dbconn.DBConn) error {
+	if name == "" {
+		return errors.New("Cluster name cannot be empty")
+	}
+	if _, ok := mc.Clusters[name]; ok {
+		return errors.Errorf("Cluster %s has already been added", name)
+	}
+	mc.Names = append(mc.Names, name)
+	mc.Clusters[name] = cluster
+	mc.Connections[name] = connection
+	return nil
+}
+
+/*
+ * Builds a Cluster from the segment configuration of the database the given
+ * connection points to, then adds it under the given name.  The connection
+ * must already be connected.
+ */
+func (mc *MultiCluster) AddClusterFromConnection(name string, connection *dbconn.DBConn) error {
+	segConfigs, err := GetSegmentConfiguration(connection)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to get segment configuration for cluster %s", name)
+	}
+	return mc.AddCluster(name, NewCluster(segConfigs), connection)
+}
+
+func (mc *MultiCluster) MustAddClusterFromConnection(name string, connection *dbconn.DBConn) {
+	err := mc.AddClusterFromConnection(name, connection)
+	gplog.FatalOnError(err)
+}
+
+func (mc *MultiCluster) GetCluster(name string) *Cluster {
+	return mc.Clusters[name]
+}
+
+func (mc *MultiCluster) GetConnection(name string) *dbconn.DBConn {
+	return mc.Connections[name]
+}
+
+func (mc *MultiCluster) Close() {
+	for _, name := range mc.Names {
+		if connection := mc.Connections[name]; connection != nil {
+			connection.Close()
+		}
+	}
+}
+
+type clusterNames []string
+
+/*
+ * Passing this option to MultiCluster.GenerateAndExecuteCommand runs the
+ * command only on the named clusters, instead of on every cluster.  Naming a
+ * cluster that has not been added is a programmer error.
+ */
+func SelectClusters(names ...string) CommandOption {
+	return clusterNames(names)
+}
+
+func (names clusterNames) applyTo(options *commandOptions) {
+	options.clusterNames = append(options.clusterNames, names...)
+}
+
+/*
+ * Runs a command on every cluster, or only on those named with SelectClusters,
+ * with the same scope semantics and options as Cluster.GenerateAndExecuteCommand.
+ * Commands are generated per cluster and executed on all clusters concurrently,
+ * each using that cluster's own Executor.
+ *
+ * As content IDs and host names may be the same in different clusters, the
+ * WithOutputDirectory option writes the output for each cluster to a
+ * subdirectory of the given directory named after the cluster.
+ */
+func (mc *MultiCluster) GenerateAndExecuteCommand(verboseMsg string, execFunc func(clusterName string, contentID int) string, scope int, options ...CommandOption) *MultiRemoteOutput {
+	gplog.Verbose(verboseMsg)
+	opts := newCommandOptions(options)
+	names := opts.clusterNames
+	if len(names) == 0 {
+		names = mc.Names
+	}
+	commandMaps := make(map[string]map[int][]string, len(names))
+	for _, name := range names {
+		cluster, ok := mc.Clusters[name]
+		if !ok {
+			// As with an invalid scope, this is programmer error, not user error.
+			gplog.Fatal(errors.Errorf("Invalid cluster name for command to %s: %s", strings.ToLower(verboseMsg), name), "")
+		}
+		clusterName := name
+		commandMaps[name] = cluster.generateCommandMap(verboseMsg, func(contentID int) string {
+			return execFunc(clusterName, contentID)
+		}, scope, options...)
+		cluster.checkExecutor(verboseMsg, opts)
+	}
+
+	type clusterOutput struct {
+		name   string
+		output *RemoteOutput
+	}
+	finished := make(chan clusterOutput)
+	for name, commandMap := range commandMaps {
+		clusterOpts := *opts
+		if opts.outputDir != "" {
+			clusterOpts.outputDir = filepath.Join(opts.outputDir, name)
+		}
+		go func(name string, commandMap map[int][]string, clusterOpts commandOptions) {
+			finished <- clusterOutput{name, mc.Clusters[name].executeCommandMap(scope, commandMap, &clusterOpts)}
+		}(name, commandMap, clusterOpts)
+	}
+	outputs := make(map[string]*RemoteOutput, len(commandMaps))
+	for range commandMaps {
+		result := <-finished
+		outputs[result.name] = result.output
+	}
+	return newMultiRemoteOutput(scope, outputs)
+}
+
+func newMultiRemoteOutput(scope int, outputs map[string]*RemoteOutput) *MultiRemoteOutput {
+	multiOutput := &MultiRemoteOutput{
+		Scope:   scope,
+		Stdouts: make(map[ClusterContentID]string, 0),
+		Stderrs: make(map[ClusterContentID]string, 0),
+		Errors:  make(map[ClusterContentID]error, 0),
+		CmdStrs: make(map[ClusterContentID]string, 0),
+		Outputs: outputs,
+	}
+	for name, output := range outputs {
+		if output == nil {
+			continue
+		}
+		multiOutput.NumErrors += output.NumErrors
+		for contentID, stdout := range output.Stdouts {
+			multiOutput.Stdouts[ClusterContentID{name, contentID}] = stdout
+		}
+		for contentID, stderr := range output.Stderrs {
+			multiOutput.Stderrs[ClusterContentID{name, contentID}] = stderr
+		}
+		for contentID, err := range output.Errors {
+			multiOutput.Errors[ClusterContentID{name, contentID}] = err
+		}
+		for contentID, cmdStr := range output.CmdStrs {
+			multiOutput.CmdStrs[ClusterContentID{name, contentID}] = cmdStr
+		}
+	}
+	return multiOutput
+}
+
+/*
+ * Returns the names of the clusters on which at least one command failed, in
+ * the order the clusters were added.
+ */
+func (mc *MultiCluster) GetFailedClusters(multiOutput *MultiRemoteOutput) []string {
+	failed := make([]string, 0)
+	for _, name := range mc.Names {
+		if output := multiOutput.Outputs[name]; output != nil && output.NumErrors > 0 {
+			failed = append(failed, name)
+		}
+	}
+	return failed
+}
+
+/*
+ * This function behaves like Cluster.CheckClusterError, but also reports the
+ * cluster on which each error occurred and which clusters had any errors.
+ */
+func (mc *MultiCluster) CheckClusterError(multiOutput *MultiRemoteOutput, finalErrMsg string, messageFunc func(clusterName string, contentID int) string, noFatal ...bool) {
+	if multiOutput.NumErrors == 0 {
+		return
+	}
+
+	failedIDs := make([]ClusterContentID, 0, multiOutput.NumErrors)
+	for id, err := range multiOutput.Errors {
+		if err != nil {
+			failedIDs = append(failedIDs, id)
+		}
+	}
+	clusterIndexes := make(map[string]int, len(mc.Names))
+	for i, name := range mc.Names {
+		clusterIndexes[name] = i
+	}
+	sort.Slice(failedIDs, func(i, j int) bool {
+		if failedIDs[i].ClusterName != failedIDs[j].ClusterName {
+			return clusterIndexes[failedIDs[i].ClusterName] < clusterIndexes[failedIDs[j].ClusterName]
+		}
+		return failedIDs[i].ContentID < failedIDs[j].ContentID
+	})
+	for _, id := range failedIDs {
+		dest := mc.Clusters[id.ClusterName].describeDestination(multiOutput.Scope, id.ContentID)
+		gplog.Verbose("%s in cluster %s %s with error %s: %s", messageFunc(id.ClusterName, id.ContentID), id.ClusterName, dest, multiOutput.Errors[id], multiOutput.Outputs[id.ClusterName].getStderr(id.ContentID))
+		gplog.Verbose("Command was: %s", multiOutput.CmdStrs[id])
+	}
+
+	failedClusters := strings.Join(mc.GetFailedClusters(multiOutput), ", ")
+	if len(noFatal) == 1 && noFatal[0] == true {
+		gplog.Error("%s in cluster(s) %s", finalErrMsg, failedClusters)
+	} else {
+		gplog.Fatal(errors.Errorf("%s in cluster(s) %s. See %s for a complete list of errors.", summarizeClusterError(finalErrMsg, multiOutput.Scope, multiOutput.NumErrors), failedClusters, gplog.GetLogFilePath()), "")
+	}
+}
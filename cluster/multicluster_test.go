@@ -0,0 +1,193 @@
+package cluster_test
+
+import (
+	"fmt"
+	"os/user"
+
+	"github.com/greenplum-db/gp-common-go-libs/cluster"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+	"github.com/pkg/errors"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("cluster/multicluster tests", func() {
+	sourceMaster := cluster.SegConfig{DbID: 1, ContentID: -1, Port: 5432, Hostname: "mdw", DataDir: "/data/gpseg-1"}
+	sourceSeg := cluster.SegConfig{DbID: 2, ContentID: 0, Port: 20000, Hostname: "sdw1", DataDir: "/data/gpseg0"}
+	targetMaster := cluster.SegConfig{DbID: 1, ContentID: -1, Port: 6432, Hostname: "mdw2", DataDir: "/data/gpseg-1"}
+	targetSeg := cluster.SegConfig{DbID: 2, ContentID: 0, Port: 30000, Hostname: "sdw9", DataDir: "/data/gpseg0"}
+	var (
+		multiCluster   *cluster.MultiCluster
+		sourceExecutor *testhelper.TestExecutor
+		targetExecutor *testhelper.TestExecutor
+	)
+
+	BeforeEach(func() {
+		operating.System.CurrentUser = func() (*user.User, error) { return &user.User{Username: "testUser", HomeDir: "testDir"}, nil }
+		sourceExecutor = &testhelper.TestExecutor{ClusterOutput: &cluster.RemoteOutput{
+			Stdouts: map[int]string{0: "source output"},
+			Errors:  map[int]error{0: nil},
+		}}
+		targetExecutor = &testhelper.TestExecutor{ClusterOutput: &cluster.RemoteOutput{
+			Stdouts: map[int]string{0: "target output"},
+			Errors:  map[int]error{0: nil},
+		}}
+		sourceCluster := cluster.NewCluster([]cluster.SegConfig{sourceMaster, sourceSeg})
+		sourceCluster.Executor = sourceExecutor
+		targetCluster := cluster.NewCluster([]cluster.SegConfig{targetMaster, targetSeg})
+		targetCluster.Executor = targetExecutor
+		targetCluster.SSHUser = "gpadmin"
+		targetCluster.SSHOptions = []string{"-p", "2222"}
+
+		multiCluster = cluster.NewMultiCluster()
+		Expect(multiCluster.AddCluster("source", sourceCluster, connection)).To(Succeed())
+		Expect(multiCluster.AddCluster("target", targetCluster, nil)).To(Succeed())
+	})
+	Describe("AddCluster", func() {
+		It("keeps clusters in the order they were added", func() {
+			Expect(multiCluster.Names).To(Equal([]string{"source", "target"}))
+			Expect(multiCluster.GetCluster("target").GetHostForContent(0)).To(Equal("sdw9"))
+			Expect(multiCluster.GetConnection("source")).To(Equal(connection))
+			Expect(multiCluster.GetConnection("target")).To(BeNil())
+		})
+		It("returns an error if a cluster name is reused", func() {
+			err := multiCluster.AddCluster("source", cluster.NewCluster(nil), nil)
+			Expect(err).To(MatchError("Cluster source has already been added"))
+		})
+		It("returns an error if the cluster name is empty", func() {
+			err := multiCluster.AddCluster("", cluster.NewCluster(nil), nil)
+			Expect(err).To(MatchError("Cluster name cannot be empty"))
+		})
+	})
+	Describe("AddClusterFromConnection", func() {
+		It("builds a cluster from the segment configuration of the connection", func() {
+			fakeResult := sqlmock.NewRows([]string{"contentid", "hostname", "datadir"}).AddRow("-1", "otherhost", "/data/gpseg-1").AddRow("0", "otherhost", "/data/gpseg0")
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(fakeResult)
+			err := multiCluster.AddClusterFromConnection("other", connection)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(multiCluster.Names).To(Equal([]string{"source", "target", "other"}))
+			Expect(multiCluster.GetCluster("other").GetContentList()).To(Equal([]int{-1, 0}))
+			Expect(multiCluster.GetCluster("other").GetHostForContent(0)).To(Equal("otherhost"))
+		})
+		It("names the cluster in the error if the segment configuration cannot be retrieved", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnError(errors.New("query failed"))
+			err := multiCluster.AddClusterFromConnection("other", connection)
+			Expect(err).To(MatchError("Unable to get segment configuration for cluster other: query failed"))
+			Expect(multiCluster.Names).To(Equal([]string{"source", "target"}))
+		})
+	})
+	Describe("GenerateAndExecuteCommand", func() {
+		generateCommand := func(clusterName string, contentID int) string {
+			return fmt.Sprintf("echo %s %d", clusterName, contentID)
+		}
+		It("runs commands on every cluster with each cluster's settings", func() {
+			output := multiCluster.GenerateAndExecuteCommand("Running echo", generateCommand, cluster.ON_SEGMENTS)
+
+			Expect(sourceExecutor.ClusterCommands).To(Equal([]map[int][]string{{
+				0: {"ssh", "-o", "StrictHostKeyChecking=no", "testUser@sdw1", "echo source 0"},
+			}}))
+			Expect(targetExecutor.ClusterCommands).To(Equal([]map[int][]string{{
+				0: {"ssh", "-o", "StrictHostKeyChecking=no", "-p", "2222", "gpadmin@sdw9", "echo target 0"},
+			}}))
+			Expect(output.NumErrors).To(Equal(0))
+			Expect(output.Stdouts).To(Equal(map[cluster.ClusterContentID]string{
+				{ClusterName: "source", ContentID: 0}: "source output",
+				{ClusterName: "target", ContentID: 0}: "target output",
+			}))
+		})
+		It("runs commands only on the named clusters", func() {
+			output := multiCluster.GenerateAndExecuteCommand("Running echo", generateCommand, cluster.ON_MASTER_TO_SEGMENTS_AND_MASTER, cluster.SelectClusters("target"))
+
+			Expect(sourceExecutor.NumExecutions).To(Equal(0))
+			Expect(targetExecutor.ClusterCommands).To(Equal([]map[int][]string{{
+				-1: {"bash", "-c", "echo target -1"},
+				0:  {"bash", "-c", "echo target 0"},
+			}}))
+			Expect(output.Outputs).To(HaveLen(1))
+			Expect(output.Stdouts[cluster.ClusterContentID{ClusterName: "target", ContentID: 0}]).To(Equal("target output"))
+		})
+		It("passes selectors and run-as options to every cluster", func() {
+			sourceExecutor.ClusterOutput.Errors = map[int]error{-1: errors.New("exit status 1")}
+			sourceExecutor.ClusterOutput.Stderrs = map[int]string{-1: "su: Authentication failure"}
+			output := multiCluster.GenerateAndExecuteCommand("Running echo", generateCommand, cluster.ON_MASTER_TO_SEGMENTS_AND_MASTER, cluster.SelectContentIDs(-1), cluster.RunAsUser("gpadmin"))
+
+			Expect(sourceExecutor.ClusterCommands).To(Equal([]map[int][]string{{
+				-1: {"bash", "-c", "su - 'gpadmin' -c 'echo source -1'"},
+			}}))
+			Expect(targetExecutor.ClusterCommands).To(Equal([]map[int][]string{{
+				-1: {"bash", "-c", "su - 'gpadmin' -c 'echo target -1'"},
+			}}))
+			Expect(output.Errors[cluster.ClusterContentID{ClusterName: "source", ContentID: -1}]).To(MatchError("Unable to run command as user gpadmin via su; permission denied (exit status 1)"))
+		})
+		It("writes the output for each cluster to its own subdirectory", func() {
+			multiCluster.GenerateAndExecuteCommand("Running echo", generateCommand, cluster.ON_SEGMENTS, cluster.WithOutputDirectory("/tmp/output"))
+
+			Expect(sourceExecutor.OutputFiles).To(Equal([]map[int]cluster.OutputFile{{
+				0: {StdoutPath: "/tmp/output/source/sdw1_0.out", StderrPath: "/tmp/output/source/sdw1_0.err"},
+			}}))
+			Expect(targetExecutor.OutputFiles).To(Equal([]map[int]cluster.OutputFile{{
+				0: {StdoutPath: "/tmp/output/target/sdw9_0.out", StderrPath: "/tmp/output/target/sdw9_0.err"},
+			}}))
+		})
+		It("panics if an unknown cluster is named", func() {
+			defer testhelper.ShouldPanicWithMessage("Invalid cluster name for command to running echo: nonexistent")
+			multiCluster.GenerateAndExecuteCommand("Running echo", generateCommand, cluster.ON_SEGMENTS, cluster.SelectClusters("nonexistent"))
+		})
+	})
+	Describe("CheckClusterError", func() {
+		var multiOutput *cluster.MultiRemoteOutput
+		BeforeEach(func() {
+			targetExecutor.ClusterOutput = &cluster.RemoteOutput{
+				NumErrors: 1,
+				Stderrs:   map[int]string{0: "exit status 1"},
+				Errors:    map[int]error{0: errors.New("ssh error")},
+				CmdStrs:   map[int]string{0: "this is the command"},
+			}
+			multiOutput = multiCluster.GenerateAndExecuteCommand("Running echo", func(string, int) string { return "ls" }, cluster.ON_SEGMENTS)
+		})
+		It("reports which clusters failed", func() {
+			Expect(multiOutput.NumErrors).To(Equal(1))
+			Expect(multiCluster.GetFailedClusters(multiOutput)).To(Equal([]string{"target"}))
+		})
+		It("logs errors with the cluster on which they occurred", func() {
+			defer testhelper.ShouldPanicWithMessage("Got an error on 1 segment in cluster(s) target. See gbytes.Buffer for a complete list of errors.")
+			defer Expect(logfile).To(gbytes.Say(`\[DEBUG\]:-Command was: this is the command`))
+			defer Expect(logfile).To(gbytes.Say(`\[DEBUG\]:-Error received in cluster target on segment 0 on host sdw9 with error ssh error: exit status 1`))
+			multiCluster.CheckClusterError(multiOutput, "Got an error", func(clusterName string, contentID int) string {
+				return "Error received"
+			})
+		})
+		It("does not panic if noFatal is true", func() {
+			multiCluster.CheckClusterError(multiOutput, "Got an error", func(clusterName string, contentID int) string {
+				return "Error received"
+			}, true)
+			Expect(logfile).To(gbytes.Say(`\[ERROR\]:-Got an error in cluster\(s\) target`))
+		})
+		It("lists errors in the order the clusters were added", func() {
+			failingOutput := &cluster.RemoteOutput{
+				NumErrors: 1,
+				Errors:    map[int]error{0: errors.New("ssh error")},
+				CmdStrs:   map[int]string{0: "this is the command"},
+			}
+			laterCluster := cluster.NewCluster([]cluster.SegConfig{sourceMaster, sourceSeg})
+			laterCluster.Executor = &testhelper.TestExecutor{ClusterOutput: failingOutput}
+			earlierCluster := cluster.NewCluster([]cluster.SegConfig{targetMaster, targetSeg})
+			earlierCluster.Executor = &testhelper.TestExecutor{ClusterOutput: failingOutput}
+			multiCluster = cluster.NewMultiCluster()
+			Expect(multiCluster.AddCluster("zeta", earlierCluster, nil)).To(Succeed())
+			Expect(multiCluster.AddCluster("alpha", laterCluster, nil)).To(Succeed())
+			multiOutput = multiCluster.GenerateAndExecuteCommand("Running echo", func(string, int) string { return "ls" }, cluster.ON_SEGMENTS)
+
+			multiCluster.CheckClusterError(multiOutput, "Got an error", func(clusterName string, contentID int) string {
+				return "Error received"
+			}, true)
+			Expect(logfile).To(gbytes.Say(`Error received in cluster zeta`))
+			Expect(logfile).To(gbytes.Say(`Error received in cluster alpha`))
+			Expect(logfile).To(gbytes.Say(`\[ERROR\]:-Got an error in cluster\(s\) zeta, alpha`))
+		})
+	})
+})
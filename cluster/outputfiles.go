@@ -0,0 +1,164 @@
+package cluster
+
+/*
+ * This file contains structs and functions related to writing the output of
+ * cluster commands to local files instead of holding it in memory.
+ */
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/greenplum-db/gp-common-go-libs/iohelper"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+)
+
+/*
+ * For commands run with the WithOutputDirectory option, RemoteOutput.Stdouts
+ * and RemoteOutput.Stderrs are left empty, and RemoteOutput.OutputFiles
+ * instead records where each command's output was written and how large it is.
+ */
+type OutputFile struct {
+	StdoutPath string
+	StderrPath string
+	StdoutSize int64
+	StderrSize int64
+}
+
+const maxStderrReadSize = 4096
+
+type outputDirectory string
+
+/*
+ * Passing this option to GenerateAndExecuteCommand writes the stdout and stderr
+ * of each command to files named <host>_<contentID>.out and .err in the given
+ * local directory, which is created if it does not exist, or <host>.out and
+ * .err for commands run once per host.  Existing files with the same names are
+ * overwritten.  The cluster's Executor must implement FileExecutor.
+ */
+func WithOutputDirectory(dir string) CommandOption {
+	return outputDirectory(dir)
+}
+
+func (dir outputDirectory) applyTo(options *commandOptions) {
+	options.outputDir = string(dir)
+}
+
+/*
+ * The command map for a host scope is keyed by an arbitrary content ID on each
+ * host, so the content ID is left out of the file names for those scopes to
+ * keep them the same from one run to the next.
+ */
+func (cluster *Cluster) GetOutputFiles(dir string, scope int, commandMap map[int][]string) map[int]OutputFile {
+	perHost := scope == ON_HOSTS || scope == ON_HOSTS_AND_MASTER || scope == ON_MASTER_TO_HOSTS || scope == ON_MASTER_TO_HOSTS_AND_MASTER
+	outputFiles := make(map[int]OutputFile, len(commandMap))
+	for contentID := range commandMap {
+		name := fmt.Sprintf("%s_%d", cluster.GetHostForContent(contentID), contentID)
+		if perHost {
+			name = cluster.GetHostForContent(contentID)
+		}
+		prefix := filepath.Join(dir, name)
+		outputFiles[contentID] = OutputFile{StdoutPath: prefix + ".out", StderrPath: prefix + ".err"}
+	}
+	return outputFiles
+}
+
+func (executor *GPDBExecutor) ExecuteClusterCommandToFiles(scope int, commandMap map[int][]string, outputFiles map[int]OutputFile) *RemoteOutput {
+	type fileResult struct {
+		contentID  int
+		outputFile OutputFile
+		err        error
+	}
+	finished := make(chan fileResult)
+	for contentID, segCommand := range commandMap {
+		go func(contentID int, segCommand []string, outputFile OutputFile) {
+			err := runCommandToFiles(segCommand, &outputFile)
+			finished <- fileResult{contentID, outputFile, err}
+		}(contentID, segCommand, outputFiles[contentID])
+	}
+	output := newRemoteOutput(scope, len(commandMap))
+	output.OutputFiles = make(map[int]OutputFile, len(commandMap))
+	for range commandMap {
+		result := <-finished
+		id := result.contentID
+		output.OutputFiles[id] = result.outputFile
+		output.Errors[id] = result.err
+		output.CmdStrs[id] = fmt.Sprintf("%s > %s 2> %s", strings.Join(commandMap[id], " "), result.outputFile.StdoutPath, result.outputFile.StderrPath)
+		if result.err != nil {
+			output.NumErrors++
+		}
+	}
+	return output
+}
+
+func runCommandToFiles(segCommand []string, outputFile *OutputFile) (err error) {
+	err = operating.System.MkdirAll(filepath.Dir(outputFile.StdoutPath), 0755)
+	if err != nil {
+		return err
+	}
+	stdoutHandle, err := iohelper.OpenFileForWriting(outputFile.StdoutPath)
+	if err != nil {
+		return err
+	}
+	defer closeOutputFile(stdoutHandle, &err)
+	stderrHandle, err := iohelper.OpenFileForWriting(outputFile.StderrPath)
+	if err != nil {
+		return err
+	}
+	defer closeOutputFile(stderrHandle, &err)
+
+	stdout := &countingWriter{writer: stdoutHandle}
+	stderr := &countingWriter{writer: stderrHandle}
+	cmd := exec.Command(segCommand[0], segCommand[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	outputFile.StdoutSize = stdout.count
+	outputFile.StderrSize = stderr.count
+	return err
+}
+
+/*
+ * A command error takes precedence over an error closing its output files, but
+ * a command that succeeded with incompletely written output is still a failure.
+ */
+func closeOutputFile(handle io.Closer, err *error) {
+	closeErr := handle.Close()
+	if *err == nil {
+		*err = closeErr
+	}
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+/*
+ * Returns the stderr of a command, reading it back from its stderr file if the
+ * output was written to files.  Only the beginning of a stderr file is read,
+ * which is enough to check for error messages such as those from sudo or su.
+ */
+func (output *RemoteOutput) readStderr(contentID int) string {
+	outputFile, ok := output.OutputFiles[contentID]
+	if !ok {
+		return output.Stderrs[contentID]
+	}
+	handle, err := iohelper.OpenFileForReading(outputFile.StderrPath)
+	if err != nil {
+		return ""
+	}
+	defer handle.Close()
+	contents, _ := ioutil.ReadAll(io.LimitReader(handle, maxStderrReadSize))
+	return string(contents)
+}
@@ -0,0 +1,145 @@
+package cluster_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/greenplum-db/gp-common-go-libs/cluster"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+/*
+ * Implements only the Executor interface, as executors written before
+ * FileExecutor was added do.
+ */
+type clusterOnlyExecutor struct {
+	called bool
+}
+
+func (executor *clusterOnlyExecutor) ExecuteLocalCommand(commandStr string) (string, error) {
+	executor.called = true
+	return "", nil
+}
+
+func (executor *clusterOnlyExecutor) ExecuteClusterCommand(scope int, commandMap map[int][]string) *cluster.RemoteOutput {
+	executor.called = true
+	return &cluster.RemoteOutput{}
+}
+
+var _ = Describe("cluster/outputfiles tests", func() {
+	masterSeg := cluster.SegConfig{DbID: 1, ContentID: -1, Port: 5432, Hostname: "localhost", DataDir: "/data/gpseg-1"}
+	remoteSeg := cluster.SegConfig{DbID: 2, ContentID: 0, Port: 20000, Hostname: "remotehost1", DataDir: "/data/gpseg0"}
+	outputDir := "/tmp/gp_common_go_libs_test/output"
+	var testCluster *cluster.Cluster
+
+	BeforeEach(func() {
+		testCluster = cluster.NewCluster([]cluster.SegConfig{masterSeg, remoteSeg})
+	})
+	AfterEach(func() {
+		os.RemoveAll("/tmp/gp_common_go_libs_test")
+	})
+	Describe("GetOutputFiles", func() {
+		It("names output files by host and content ID", func() {
+			outputFiles := testCluster.GetOutputFiles(outputDir, cluster.ON_SEGMENTS_AND_MASTER, map[int][]string{-1: {"ls"}, 0: {"ls"}})
+			Expect(outputFiles).To(Equal(map[int]cluster.OutputFile{
+				-1: {StdoutPath: outputDir + "/localhost_-1.out", StderrPath: outputDir + "/localhost_-1.err"},
+				0:  {StdoutPath: outputDir + "/remotehost1_0.out", StderrPath: outputDir + "/remotehost1_0.err"},
+			}))
+		})
+		It("names output files by host alone for host scopes", func() {
+			remoteSegTwo := cluster.SegConfig{DbID: 3, ContentID: 1, Port: 20001, Hostname: "remotehost1", DataDir: "/data/gpseg1"}
+			testCluster = cluster.NewCluster([]cluster.SegConfig{masterSeg, remoteSeg, remoteSegTwo})
+			for _, contentID := range []int{0, 1} {
+				outputFiles := testCluster.GetOutputFiles(outputDir, cluster.ON_HOSTS, map[int][]string{contentID: {"ls"}})
+				Expect(outputFiles).To(Equal(map[int]cluster.OutputFile{
+					contentID: {StdoutPath: outputDir + "/remotehost1.out", StderrPath: outputDir + "/remotehost1.err"},
+				}))
+			}
+		})
+	})
+	Describe("GenerateAndExecuteCommand with WithOutputDirectory", func() {
+		It("passes output file paths to the executor", func() {
+			testExecutor := &testhelper.TestExecutor{ClusterOutput: &cluster.RemoteOutput{}}
+			testCluster.Executor = testExecutor
+			testCluster.GenerateAndExecuteCommand("Listing files", func(int) string { return "ls" }, cluster.ON_SEGMENTS, cluster.WithOutputDirectory(outputDir))
+
+			Expect(testExecutor.ClusterCommands).To(HaveLen(1))
+			Expect(testExecutor.OutputFiles).To(Equal([]map[int]cluster.OutputFile{{
+				0: {StdoutPath: outputDir + "/remotehost1_0.out", StderrPath: outputDir + "/remotehost1_0.err"},
+			}}))
+		})
+	})
+	Describe("GenerateAndExecuteCommand with an Executor that does not implement FileExecutor", func() {
+		It("panics without running any commands", func() {
+			testExecutor := &clusterOnlyExecutor{}
+			testCluster.Executor = testExecutor
+			defer func() {
+				Expect(testExecutor.called).To(BeFalse())
+			}()
+			defer testhelper.ShouldPanicWithMessage("Cannot write output of command to echoing to files; executor of type *cluster_test.clusterOnlyExecutor does not implement FileExecutor")
+			testCluster.GenerateAndExecuteCommand("Echoing", func(int) string { return "echo master" }, cluster.ON_SEGMENTS, cluster.WithOutputDirectory(outputDir))
+		})
+	})
+	Describe("ExecuteClusterCommandToFiles", func() {
+		It("writes the output of each command to files and records their sizes", func() {
+			commandMap := map[int][]string{
+				-1: {"bash", "-c", "echo master; echo oops >&2"},
+				0:  {"bash", "-c", "echo segment"},
+			}
+			executor := &cluster.GPDBExecutor{}
+			output := executor.ExecuteClusterCommandToFiles(cluster.ON_SEGMENTS_AND_MASTER, commandMap, testCluster.GetOutputFiles(outputDir, cluster.ON_SEGMENTS_AND_MASTER, commandMap))
+
+			Expect(output.NumErrors).To(Equal(0))
+			Expect(output.Stdouts).To(BeEmpty())
+			masterFile := output.OutputFiles[-1]
+			Expect(masterFile.StdoutSize).To(Equal(int64(7)))
+			Expect(masterFile.StderrSize).To(Equal(int64(5)))
+			contents, _ := ioutil.ReadFile(masterFile.StdoutPath)
+			Expect(string(contents)).To(Equal("master\n"))
+			contents, _ = ioutil.ReadFile(masterFile.StderrPath)
+			Expect(string(contents)).To(Equal("oops\n"))
+			contents, _ = ioutil.ReadFile(output.OutputFiles[0].StdoutPath)
+			Expect(string(contents)).To(Equal("segment\n"))
+			Expect(output.CmdStrs[0]).To(Equal("bash -c echo segment > " + outputDir + "/remotehost1_0.out 2> " + outputDir + "/remotehost1_0.err"))
+		})
+		It("returns any errors generated by any of the commands", func() {
+			commandMap := map[int][]string{
+				-1: {"bash", "-c", "echo fine"},
+				0:  {"bash", "-c", "echo failed >&2; exit 3"},
+			}
+			executor := &cluster.GPDBExecutor{}
+			output := executor.ExecuteClusterCommandToFiles(cluster.ON_SEGMENTS_AND_MASTER, commandMap, testCluster.GetOutputFiles(outputDir, cluster.ON_SEGMENTS_AND_MASTER, commandMap))
+
+			Expect(output.NumErrors).To(Equal(1))
+			Expect(output.Errors[0]).To(MatchError("exit status 3"))
+			Expect(output.OutputFiles[0].StderrSize).To(Equal(int64(7)))
+		})
+		It("returns an error if an output file cannot be created", func() {
+			commandMap := map[int][]string{0: {"echo", "hi"}}
+			outputFiles := map[int]cluster.OutputFile{0: {StdoutPath: "/dev/null/nonexistent/out", StderrPath: "/dev/null/nonexistent/err"}}
+			executor := &cluster.GPDBExecutor{}
+			output := executor.ExecuteClusterCommandToFiles(cluster.ON_SEGMENTS, commandMap, outputFiles)
+
+			Expect(output.NumErrors).To(Equal(1))
+			Expect(output.Errors[0]).To(HaveOccurred())
+		})
+	})
+	Describe("CheckClusterError", func() {
+		It("points to the stderr file instead of logging stderr", func() {
+			remoteOutput := &cluster.RemoteOutput{
+				Scope:       cluster.ON_SEGMENTS,
+				NumErrors:   1,
+				Errors:      map[int]error{0: errors.New("exit status 1")},
+				CmdStrs:     map[int]string{0: "this is the command"},
+				OutputFiles: map[int]cluster.OutputFile{0: {StdoutPath: "/tmp/out", StderrPath: "/tmp/err"}},
+			}
+			testCluster.CheckClusterError(remoteOutput, "Got an error", func(int) string { return "Error received" }, true)
+			Expect(logfile).To(gbytes.Say(`\[DEBUG\]:-Error received on segment 0 on host remotehost1 with error exit status 1: see /tmp/err`))
+		})
+	})
+})
@@ -0,0 +1,134 @@
+package cluster
+
+/*
+ * This file contains structs and functions related to running cluster
+ * commands as a different user, either as root via sudo or as another user
+ * such as gpadmin via su.
+ */
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/pkg/errors"
+)
+
+const (
+	ESCALATE_SUDO = iota
+	ESCALATE_SU
+)
+
+/*
+ * A RunAs option runs each generated command as another user, with an empty
+ * User meaning root.  sudo is always invoked in non-interactive mode, so a
+ * command fails instead of hanging on a password prompt if the current user
+ * may not run it without a password.  su runs the command in a login shell for
+ * the target user, and will only succeed without a prompt if the current user
+ * is root.
+ *
+ * The command string is quoted so it is passed through unchanged as a single
+ * argument to bash, and the wrapped command can be run locally or over ssh.
+ */
+type RunAs struct {
+	Method int
+	User   string
+}
+
+func RunAsRoot() *RunAs {
+	return &RunAs{Method: ESCALATE_SUDO}
+}
+
+func RunAsSudo(user string) *RunAs {
+	return &RunAs{Method: ESCALATE_SUDO, User: user}
+}
+
+func RunAsUser(user string) *RunAs {
+	return &RunAs{Method: ESCALATE_SU, User: user}
+}
+
+func (runAs *RunAs) applyTo(options *commandOptions) {
+	options.runAs = runAs
+}
+
+func (runAs *RunAs) targetUser() string {
+	if runAs.User == "" {
+		return "root"
+	}
+	return runAs.User
+}
+
+func (runAs *RunAs) methodName() string {
+	if runAs.Method == ESCALATE_SU {
+		return "su"
+	}
+	return "sudo"
+}
+
+func (runAs *RunAs) WrapCommand(cmdStr string) string {
+	switch runAs.Method {
+	case ESCALATE_SUDO:
+		userFlag := ""
+		if runAs.User != "" {
+			userFlag = fmt.Sprintf("-u %s ", ShellQuote(runAs.User))
+		}
+		return fmt.Sprintf("sudo -n %s-- bash -c %s", userFlag, ShellQuote(cmdStr))
+	case ESCALATE_SU:
+		return fmt.Sprintf("su - %s -c %s", ShellQuote(runAs.targetUser()), ShellQuote(cmdStr))
+	}
+	// If we ever get to this case, it's programmer error, not user error.
+	gplog.Fatal(errors.Errorf("Invalid privilege escalation method: %d", runAs.Method), "")
+	return ""
+}
+
+/*
+ * These are the messages sudo and su print when the current user is not
+ * allowed to switch to the target user; a command that fails for any other
+ * reason is left as-is.
+ */
+var escalationDeniedMessages = []string{
+	"sudo: a password is required",
+	"sudo: a terminal is required",
+	"sudo: no tty present",
+	"is not in the sudoers file",
+	"is not allowed to execute",
+	"sudo: unknown user",
+	"su: Authentication failure",
+	"su: must be run from a terminal",
+	"does not exist",
+	"su: Sorry",
+	"This account is currently not available",
+}
+
+func IsEscalationDenied(stderr string) bool {
+	for _, message := range escalationDeniedMessages {
+		if strings.Contains(stderr, message) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Replaces the generic "exit status 1" error for commands that failed because
+ * privileges could not be escalated with an error saying so, so that
+ * CheckClusterError output distinguishes those failures from failures of the
+ * command itself.
+ */
+func (runAs *RunAs) annotateErrors(output *RemoteOutput) {
+	if output == nil {
+		return
+	}
+	for contentID, err := range output.Errors {
+		if err != nil && IsEscalationDenied(output.readStderr(contentID)) {
+			output.Errors[contentID] = errors.Errorf("Unable to run command as user %s via %s; permission denied (%v)", runAs.targetUser(), runAs.methodName(), err)
+		}
+	}
+}
+
+/*
+ * Quotes a string for use as a single word in a bash command line.
+ */
+func ShellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", `'"'"'`, -1) + "'"
+}
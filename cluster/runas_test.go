@@ -0,0 +1,90 @@
+package cluster_test
+
+import (
+	"os/user"
+
+	"github.com/greenplum-db/gp-common-go-libs/cluster"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("cluster/runas tests", func() {
+	masterSeg := cluster.SegConfig{DbID: 1, ContentID: -1, Port: 5432, Hostname: "localhost", DataDir: "/data/gpseg-1"}
+	remoteSeg := cluster.SegConfig{DbID: 2, ContentID: 0, Port: 20000, Hostname: "remotehost1", DataDir: "/data/gpseg0"}
+	var testCluster *cluster.Cluster
+
+	BeforeEach(func() {
+		operating.System.CurrentUser = func() (*user.User, error) { return &user.User{Username: "testUser", HomeDir: "testDir"}, nil }
+		testCluster = cluster.NewCluster([]cluster.SegConfig{masterSeg, remoteSeg})
+	})
+	Describe("ShellQuote", func() {
+		It("quotes a simple string", func() {
+			Expect(cluster.ShellQuote("ls -l /tmp")).To(Equal(`'ls -l /tmp'`))
+		})
+		It("quotes a string containing single quotes", func() {
+			Expect(cluster.ShellQuote(`echo 'it''s'`)).To(Equal(`'echo '"'"'it'"'"''"'"'s'"'"''`))
+		})
+	})
+	Describe("RunAs.WrapCommand", func() {
+		It("wraps a command to run as root via sudo", func() {
+			Expect(cluster.RunAsRoot().WrapCommand("sysctl -a")).To(Equal(`sudo -n -- bash -c 'sysctl -a'`))
+		})
+		It("wraps a command to run as another user via sudo", func() {
+			Expect(cluster.RunAsSudo("gpadmin").WrapCommand("echo $HOME")).To(Equal(`sudo -n -u 'gpadmin' -- bash -c 'echo $HOME'`))
+		})
+		It("wraps a command to run as another user via su", func() {
+			Expect(cluster.RunAsUser("gpadmin").WrapCommand("cat 'my file'")).To(Equal(`su - 'gpadmin' -c 'cat '"'"'my file'"'"''`))
+		})
+		It("panics on an invalid escalation method", func() {
+			defer testhelper.ShouldPanicWithMessage("Invalid privilege escalation method: 7")
+			(&cluster.RunAs{Method: 7}).WrapCommand("ls")
+		})
+	})
+	Describe("command generation with RunAs", func() {
+		It("wraps local and ssh commands", func() {
+			commandMap := testCluster.GenerateSSHCommandMapForSegments(true, func(int) string { return "ls /root" }, cluster.RunAsRoot())
+			Expect(commandMap).To(Equal(map[int][]string{
+				-1: {"bash", "-c", `sudo -n -- bash -c 'ls /root'`},
+				0:  {"ssh", "-o", "StrictHostKeyChecking=no", "testUser@remotehost1", `sudo -n -- bash -c 'ls /root'`},
+			}))
+		})
+		It("combines with selectors", func() {
+			commandMap := testCluster.GenerateLocalCommandMapForSegments(true, func(int) string { return "whoami" }, cluster.SelectContentIDs(0), cluster.RunAsUser("gpadmin"))
+			Expect(commandMap).To(Equal(map[int][]string{
+				0: {"bash", "-c", `su - 'gpadmin' -c 'whoami'`},
+			}))
+		})
+	})
+	Describe("GenerateAndExecuteCommand with RunAs", func() {
+		It("reports a clear error when escalation is denied", func() {
+			testExecutor := &testhelper.TestExecutor{ClusterOutput: &cluster.RemoteOutput{
+				NumErrors: 2,
+				Stderrs: map[int]string{
+					-1: "sysctl: permission denied on key 'kernel.sem'",
+					0:  "sudo: a password is required\n",
+				},
+				Errors: map[int]error{
+					-1: errors.New("exit status 255"),
+					0:  errors.New("exit status 1"),
+				},
+			}}
+			testCluster.Executor = testExecutor
+			output := testCluster.GenerateAndExecuteCommand("Checking sysctl", func(int) string { return "sysctl -w kernel.sem=1" }, cluster.ON_SEGMENTS_AND_MASTER, cluster.RunAsRoot())
+
+			Expect(output.Errors[0]).To(MatchError("Unable to run command as user root via sudo; permission denied (exit status 1)"))
+			Expect(output.Errors[-1]).To(MatchError("exit status 255"))
+		})
+	})
+	Describe("IsEscalationDenied", func() {
+		It("recognizes sudo and su denial messages", func() {
+			Expect(cluster.IsEscalationDenied("testUser is not in the sudoers file.  This incident will be reported.")).To(BeTrue())
+			Expect(cluster.IsEscalationDenied("su: Authentication failure")).To(BeTrue())
+			Expect(cluster.IsEscalationDenied("su: user gpadmin does not exist")).To(BeTrue())
+			Expect(cluster.IsEscalationDenied("ls: cannot access '/foo': No such file or directory")).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,173 @@
+package cluster
+
+/*
+ * This file contains structs and functions for connecting to segments directly
+ * in utility mode and running queries on them in parallel.
+ */
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+)
+
+/*
+ * Holds a utility-mode connection to each segment, keyed by content ID, along
+ * with the content IDs in the same order as cluster.ContentIDs.
+ */
+type SegmentConnections struct {
+	ContentIDs  []int
+	Connections map[int]*dbconn.DBConn
+}
+
+/*
+ * Holds the error from each segment that failed, keyed by content ID.
+ */
+type SegmentErrors map[int]error
+
+func (segErrors SegmentErrors) Error() string {
+	contentIDs := make([]int, 0, len(segErrors))
+	for contentID := range segErrors {
+		contentIDs = append(contentIDs, contentID)
+	}
+	sort.Ints(contentIDs)
+	messages := make([]string, len(contentIDs))
+	for i, contentID := range contentIDs {
+		messages[i] = fmt.Sprintf("segment %d: %v", contentID, segErrors[contentID])
+	}
+	return fmt.Sprintf("Failed on %d segment(s): %s", len(segErrors), strings.Join(messages, "; "))
+}
+
+/*
+ * GPDB 7, and so Cloudberry, replaced the gp_session_role parameter with gp_role.
+ */
+func UtilityModeParam(version dbconn.GPDBVersion) string {
+	if version.GPDBAtLeast("7") {
+		return "gp_role"
+	}
+	return "gp_session_role"
+}
+
+/*
+ * Returns a DBConn, not yet connected, for connecting to the given segment in
+ * utility mode, using the same database, user, driver, and options as the
+ * given connection to the master; the master connection's version determines
+ * how utility mode is requested.
+ */
+func (cluster *Cluster) NewSegmentDBConn(master *dbconn.DBConn, contentID int) *dbconn.DBConn {
+	seg := cluster.Segments[contentID]
+	segConn := dbconn.NewDBConn(master.DBName, master.User, seg.Hostname, seg.Port)
+	segConn.Driver = master.Driver
+	segConn.ConnectionOptions = master.ConnectionOptions
+	segConn.RuntimeParams = make(map[string]string, len(master.RuntimeParams)+1)
+	for name, value := range master.RuntimeParams {
+		segConn.RuntimeParams[name] = value
+	}
+	segConn.RuntimeParams[UtilityModeParam(master.Version)] = "utility"
+	return segConn
+}
+
+/*
+ * Connects to each segment matching the given selectors, or to every segment if
+ * none are given, in parallel, with numConns connections to each.  The master
+ * is never included.  If connecting to any segment fails, the connections that
+ * succeeded are closed and a SegmentErrors is returned.
+ */
+func (cluster *Cluster) ConnectToSegments(master *dbconn.DBConn, numConns int, selectors ...SegmentSelector) (*SegmentConnections, error) {
+	segConns := &SegmentConnections{
+		ContentIDs:  make([]int, 0, len(cluster.ContentIDs)),
+		Connections: make(map[int]*dbconn.DBConn, len(cluster.ContentIDs)),
+	}
+	for _, contentID := range cluster.GetContentsMatching(selectors...) {
+		if contentID == -1 {
+			continue
+		}
+		segConns.ContentIDs = append(segConns.ContentIDs, contentID)
+		segConns.Connections[contentID] = cluster.NewSegmentDBConn(master, contentID)
+	}
+	err := segConns.Run(func(contentID int, connection *dbconn.DBConn) error {
+		return connection.Connect(numConns)
+	})
+	if err != nil {
+		segConns.Close()
+		return nil, err
+	}
+	return segConns, nil
+}
+
+func (cluster *Cluster) MustConnectToSegments(master *dbconn.DBConn, numConns int, selectors ...SegmentSelector) *SegmentConnections {
+	segConns, err := cluster.ConnectToSegments(master, numConns, selectors...)
+	gplog.FatalOnError(err)
+	return segConns
+}
+
+/*
+ * Every connection is closed, including any that failed partway through
+ * connecting, so that the connections they did open are not leaked.
+ */
+func (segConns *SegmentConnections) Close() {
+	for _, connection := range segConns.Connections {
+		connection.Close()
+	}
+}
+
+/*
+ * Calls segmentFunc with each segment's connection in parallel, and returns a
+ * SegmentErrors holding the error from each call that failed, or nil if none
+ * failed.  As segmentFunc is called from several goroutines at once, any
+ * results it collects must be guarded by a lock.
+ */
+func (segConns *SegmentConnections) Run(segmentFunc func(contentID int, connection *dbconn.DBConn) error) error {
+	segErrors := make(SegmentErrors)
+	var errLock sync.Mutex
+	var wg sync.WaitGroup
+	for _, contentID := range segConns.ContentIDs {
+		wg.Add(1)
+		go func(contentID int) {
+			defer wg.Done()
+			err := segmentFunc(contentID, segConns.Connections[contentID])
+			if err != nil {
+				errLock.Lock()
+				segErrors[contentID] = err
+				errLock.Unlock()
+			}
+		}(contentID)
+	}
+	wg.Wait()
+	if len(segErrors) > 0 {
+		return segErrors
+	}
+	return nil
+}
+
+func (segConns *SegmentConnections) Exec(query string) error {
+	return segConns.Run(func(contentID int, connection *dbconn.DBConn) error {
+		_, err := connection.Exec(query)
+		return err
+	})
+}
+
+/*
+ * Runs a query returning a single column on every segment, as with
+ * dbconn.SelectStringSlice, and returns each segment's results keyed by content
+ * ID, along with the results from segments that succeeded if any failed.
+ */
+func (segConns *SegmentConnections) SelectStringSlice(query string) (map[int][]string, error) {
+	results := make(map[int][]string, len(segConns.ContentIDs))
+	var resultLock sync.Mutex
+	err := segConns.Run(func(contentID int, connection *dbconn.DBConn) error {
+		segResults, err := dbconn.SelectStringSlice(connection, query)
+		if err != nil {
+			return err
+		}
+		resultLock.Lock()
+		results[contentID] = segResults
+		resultLock.Unlock()
+		return nil
+	})
+	return results, err
+}
@@ -0,0 +1,211 @@
+package cluster_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/greenplum-db/gp-common-go-libs/cluster"
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+/*
+ * Gives each segment its own mock database, chosen by the host and port in the
+ * connection string, and records the connection strings it is given.
+ */
+type segmentDriver struct {
+	dbs       map[string]*sqlx.DB
+	connStrs  map[string]string
+	connLock  *sync.Mutex
+	connError error
+}
+
+func (driver segmentDriver) Connect(driverName string, dataSourceName string) (*sqlx.DB, error) {
+	driver.connLock.Lock()
+	defer driver.connLock.Unlock()
+	for hostPort, db := range driver.dbs {
+		if strings.Contains(dataSourceName, "@"+hostPort+"/") {
+			driver.connStrs[hostPort] = dataSourceName
+			if driver.connError != nil && hostPort == "sdw2:20001" {
+				return nil, driver.connError
+			}
+			return db, nil
+		}
+	}
+	return nil, errors.Errorf("unexpected connection string %s", dataSourceName)
+}
+
+/*
+ * Succeeds for the first connection and fails for every later one, to leave a
+ * DBConn partly connected.
+ */
+type failAfterFirstDriver struct {
+	db          *sqlx.DB
+	connections *int
+}
+
+func (driver failAfterFirstDriver) Connect(driverName string, dataSourceName string) (*sqlx.DB, error) {
+	*driver.connections++
+	if *driver.connections > 1 {
+		return nil, errors.New("too many connections")
+	}
+	return driver.db, nil
+}
+
+var _ = Describe("cluster/segconn tests", func() {
+	masterSeg := cluster.SegConfig{DbID: 1, ContentID: -1, Port: 5432, Hostname: "mdw", DataDir: "/data/gpseg-1"}
+	seg0 := cluster.SegConfig{DbID: 2, ContentID: 0, Port: 20000, Hostname: "sdw1", DataDir: "/data/gpseg0"}
+	seg1 := cluster.SegConfig{DbID: 3, ContentID: 1, Port: 20001, Hostname: "sdw2", DataDir: "/data/gpseg1"}
+	var (
+		testCluster *cluster.Cluster
+		master      *dbconn.DBConn
+		driver      segmentDriver
+		segMocks    map[int]sqlmock.Sqlmock
+	)
+
+	BeforeEach(func() {
+		testCluster = cluster.NewCluster([]cluster.SegConfig{masterSeg, seg0, seg1})
+		master, _ = testhelper.CreateAndConnectMockDB(1)
+		master.Password = "secret"
+		master.RuntimeParams = map[string]string{"search_path": "public"}
+		driver = segmentDriver{dbs: map[string]*sqlx.DB{}, connStrs: map[string]string{}, connLock: &sync.Mutex{}}
+		segMocks = map[int]sqlmock.Sqlmock{}
+		for _, seg := range []cluster.SegConfig{seg0, seg1} {
+			db, segMock := testhelper.CreateMockDB()
+			testhelper.ExpectVersionQuery(segMock, "6.0.0")
+			driver.dbs[fmt.Sprintf("%s:%d", seg.Hostname, seg.Port)] = db
+			segMocks[seg.ContentID] = segMock
+		}
+		master.Driver = driver
+	})
+	Describe("UtilityModeParam", func() {
+		It("uses gp_session_role before GPDB 7", func() {
+			Expect(cluster.UtilityModeParam(dbconn.NewVersion("6.20.0"))).To(Equal("gp_session_role"))
+		})
+		It("uses gp_role in GPDB 7 and later", func() {
+			Expect(cluster.UtilityModeParam(dbconn.NewVersion("7.0.0"))).To(Equal("gp_role"))
+		})
+		It("uses gp_role in Cloudberry", func() {
+			version, err := dbconn.ParseVersion("PostgreSQL 14.4 (Apache Cloudberry 1.6.0 build 1)", "140004")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cluster.UtilityModeParam(version)).To(Equal("gp_role"))
+		})
+	})
+	Describe("NewSegmentDBConn", func() {
+		It("copies the master's settings and adds utility mode", func() {
+			testhelper.SetDBVersion(master, "7.0.0")
+			segConn := testCluster.NewSegmentDBConn(master, 1)
+
+			Expect(segConn.Host).To(Equal("sdw2"))
+			Expect(segConn.Port).To(Equal(20001))
+			Expect(segConn.DBName).To(Equal(master.DBName))
+			Expect(segConn.User).To(Equal(master.User))
+			Expect(segConn.Password).To(Equal("secret"))
+			Expect(segConn.RuntimeParams).To(Equal(map[string]string{"search_path": "public", "gp_role": "utility"}))
+			Expect(master.RuntimeParams).To(Equal(map[string]string{"search_path": "public"}))
+		})
+	})
+	Describe("ConnectToSegments", func() {
+		It("connects to every segment except the master in utility mode", func() {
+			testhelper.SetDBVersion(master, "6.0.0")
+			segConns, err := testCluster.ConnectToSegments(master, 2)
+			Expect(err).ToNot(HaveOccurred())
+			defer segConns.Close()
+
+			Expect(segConns.ContentIDs).To(Equal([]int{0, 1}))
+			Expect(segConns.Connections).To(HaveLen(2))
+			Expect(segConns.Connections[0].NumConns).To(Equal(2))
+			Expect(driver.connStrs["sdw1:20000"]).To(ContainSubstring("gp_session_role=utility"))
+			Expect(driver.connStrs["sdw2:20001"]).To(ContainSubstring("gp_session_role=utility"))
+		})
+		It("connects only to the selected segments", func() {
+			segConns, err := testCluster.ConnectToSegments(master, 1, cluster.SelectContentIDs(1))
+			Expect(err).ToNot(HaveOccurred())
+			defer segConns.Close()
+
+			Expect(segConns.ContentIDs).To(Equal([]int{1}))
+			Expect(driver.connStrs).ToNot(HaveKey("sdw1:20000"))
+		})
+		It("returns the error from each segment that could not be connected to", func() {
+			driver.connError = errors.New("connection refused")
+			master.Driver = driver
+
+			segConns, err := testCluster.ConnectToSegments(master, 1)
+
+			Expect(segConns).To(BeNil())
+			segErrors, ok := err.(cluster.SegmentErrors)
+			Expect(ok).To(BeTrue())
+			Expect(segErrors).To(HaveLen(1))
+			Expect(segErrors).To(HaveKey(1))
+			Expect(err.Error()).To(HavePrefix("Failed on 1 segment(s): segment 1: "))
+		})
+	})
+	Describe("SegmentConnections", func() {
+		var segConns *cluster.SegmentConnections
+
+		BeforeEach(func() {
+			segConns = testCluster.MustConnectToSegments(master, 1)
+		})
+		AfterEach(func() {
+			segConns.Close()
+		})
+		It("runs a query on every segment and returns the results by content ID", func() {
+			segMocks[0].ExpectQuery("SELECT relname FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relname"}).AddRow("foo"))
+			segMocks[1].ExpectQuery("SELECT relname FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relname"}).AddRow("bar").AddRow("baz"))
+
+			results, err := segConns.SelectStringSlice("SELECT relname FROM pg_class")
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results).To(Equal(map[int][]string{0: {"foo"}, 1: {"bar", "baz"}}))
+		})
+		It("returns the results from segments that succeeded and the errors from those that failed", func() {
+			segMocks[0].ExpectQuery("SELECT relname FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relname"}).AddRow("foo"))
+			segMocks[1].ExpectQuery("SELECT relname FROM pg_class").WillReturnError(errors.New("relation does not exist"))
+
+			results, err := segConns.SelectStringSlice("SELECT relname FROM pg_class")
+
+			Expect(results).To(Equal(map[int][]string{0: {"foo"}}))
+			Expect(err).To(MatchError("Failed on 1 segment(s): segment 1: relation does not exist"))
+		})
+		It("executes a statement on every segment", func() {
+			segMocks[0].ExpectExec("CHECKPOINT").WillReturnResult(testhelper.TestResult{})
+			segMocks[1].ExpectExec("CHECKPOINT").WillReturnResult(testhelper.TestResult{})
+
+			Expect(segConns.Exec("CHECKPOINT")).To(Succeed())
+			Expect(segMocks[0].ExpectationsWereMet()).To(Succeed())
+			Expect(segMocks[1].ExpectationsWereMet()).To(Succeed())
+		})
+		It("closes connections that failed partway through connecting", func() {
+			db, _ := testhelper.CreateMockDB()
+			connections := 0
+			partial := testCluster.NewSegmentDBConn(master, 0)
+			partial.Driver = failAfterFirstDriver{db: db, connections: &connections}
+			Expect(partial.Connect(2)).ToNot(Succeed())
+			Expect(partial.ConnPool[0]).ToNot(BeNil())
+
+			(&cluster.SegmentConnections{ContentIDs: []int{0}, Connections: map[int]*dbconn.DBConn{0: partial}}).Close()
+
+			Expect(partial.ConnPool).To(BeNil())
+		})
+		It("runs a function with each segment's connection", func() {
+			var seen sync.Map
+			err := segConns.Run(func(contentID int, connection *dbconn.DBConn) error {
+				seen.Store(contentID, connection.Port)
+				return nil
+			})
+
+			Expect(err).ToNot(HaveOccurred())
+			port, _ := seen.Load(0)
+			Expect(port).To(Equal(20000))
+			port, _ = seen.Load(1)
+			Expect(port).To(Equal(20001))
+		})
+	})
+})
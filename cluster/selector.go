@@ -0,0 +1,132 @@
+package cluster
+
+/*
+ * This file contains structs and functions related to narrowing the set of
+ * segments or hosts targeted by a cluster command.
+ */
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ * A SegmentSelector decides whether a given segment should be targeted by a
+ * command.  Selectors are passed to GenerateAndExecuteCommand and to the
+ * Generate...CommandMapFor... functions alongside a scope constant; the scope
+ * still determines whether commands are run per segment or per host and
+ * whether the master is included, and the selectors further narrow the set of
+ * segments considered within that scope.
+ *
+ * When multiple selectors are passed, a segment must match all of them to be
+ * selected.  Selectors can also be composed with And, Or, and Not.  For host
+ * scopes, the set of hosts is derived from the selected segments, so e.g.
+ * SelectDataDirPrefix("/data1") with ON_HOSTS targets every host that has at
+ * least one segment with a data directory under /data1.
+ */
+type SegmentSelector func(seg SegConfig) bool
+
+func (selector SegmentSelector) applyTo(options *commandOptions) {
+	options.selectors = append(options.selectors, selector)
+}
+
+func SelectContentIDs(contentIDs ...int) SegmentSelector {
+	idSet := make(map[int]bool, len(contentIDs))
+	for _, contentID := range contentIDs {
+		idSet[contentID] = true
+	}
+	return func(seg SegConfig) bool {
+		return idSet[seg.ContentID]
+	}
+}
+
+func SelectHosts(hostnames ...string) SegmentSelector {
+	hostSet := make(map[string]bool, len(hostnames))
+	for _, hostname := range hostnames {
+		hostSet[hostname] = true
+	}
+	return func(seg SegConfig) bool {
+		return hostSet[seg.Hostname]
+	}
+}
+
+func SelectAllExceptHosts(hostnames ...string) SegmentSelector {
+	return Not(SelectHosts(hostnames...))
+}
+
+/*
+ * The pattern uses the same syntax as filepath.Match.  As the pattern is often
+ * provided by the user, an invalid pattern is returned as an error here rather
+ * than causing every later match to silently fail.
+ */
+func SelectHostsMatching(pattern string) (SegmentSelector, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, errors.Errorf("Invalid host pattern %s: %v", pattern, err)
+	}
+	return func(seg SegConfig) bool {
+		matched, _ := filepath.Match(pattern, seg.Hostname)
+		return matched
+	}, nil
+}
+
+/*
+ * The prefix is matched against whole path components, so a prefix of "/data1"
+ * selects "/data1" and "/data1/primary/gpseg0" but not "/data10/gpseg0".
+ */
+func SelectDataDirPrefix(prefix string) SegmentSelector {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return func(seg SegConfig) bool {
+		return seg.DataDir == prefix || strings.HasPrefix(seg.DataDir, prefix+"/")
+	}
+}
+
+func (selector SegmentSelector) And(others ...SegmentSelector) SegmentSelector {
+	return matchAll(append([]SegmentSelector{selector}, others...))
+}
+
+func (selector SegmentSelector) Or(others ...SegmentSelector) SegmentSelector {
+	selectors := append([]SegmentSelector{selector}, others...)
+	return func(seg SegConfig) bool {
+		for _, s := range selectors {
+			if s(seg) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func Not(selector SegmentSelector) SegmentSelector {
+	return func(seg SegConfig) bool {
+		return !selector(seg)
+	}
+}
+
+func matchAll(selectors []SegmentSelector) SegmentSelector {
+	return func(seg SegConfig) bool {
+		for _, s := range selectors {
+			if s != nil && !s(seg) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+/*
+ * Returns the content IDs of all segments matching the given selectors, in
+ * the same order as cluster.ContentIDs.  With no selectors, every content ID
+ * in the cluster is returned.
+ */
+func (cluster *Cluster) GetContentsMatching(selectors ...SegmentSelector) []int {
+	matches := matchAll(selectors)
+	contentIDs := make([]int, 0, len(cluster.ContentIDs))
+	for _, contentID := range cluster.ContentIDs {
+		if matches(cluster.Segments[contentID]) {
+			contentIDs = append(contentIDs, contentID)
+		}
+	}
+	return contentIDs
+}
@@ -0,0 +1,105 @@
+package cluster_test
+
+import (
+	"fmt"
+	"os/user"
+
+	"github.com/greenplum-db/gp-common-go-libs/cluster"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("cluster/selector tests", func() {
+	masterSeg := cluster.SegConfig{DbID: 1, ContentID: -1, Port: 5432, Hostname: "mdw", DataDir: "/data/master/gpseg-1"}
+	segOne := cluster.SegConfig{DbID: 2, ContentID: 0, Port: 20000, Hostname: "sdw1", DataDir: "/data1/primary/gpseg0"}
+	segTwo := cluster.SegConfig{DbID: 3, ContentID: 1, Port: 20001, Hostname: "sdw1", DataDir: "/data10/primary/gpseg1"}
+	segThree := cluster.SegConfig{DbID: 4, ContentID: 2, Port: 20000, Hostname: "sdw2", DataDir: "/data1/primary/gpseg2"}
+	segFour := cluster.SegConfig{DbID: 5, ContentID: 3, Port: 20001, Hostname: "backup1", DataDir: "/data2/primary/gpseg3"}
+	var testCluster *cluster.Cluster
+
+	BeforeEach(func() {
+		operating.System.CurrentUser = func() (*user.User, error) { return &user.User{Username: "testUser", HomeDir: "testDir"}, nil }
+		testCluster = cluster.NewCluster([]cluster.SegConfig{masterSeg, segOne, segTwo, segThree, segFour})
+	})
+	Describe("GetContentsMatching", func() {
+		It("returns all contents in order if no selectors are given", func() {
+			Expect(testCluster.GetContentsMatching()).To(Equal([]int{-1, 0, 1, 2, 3}))
+		})
+		It("selects segments by content ID", func() {
+			Expect(testCluster.GetContentsMatching(cluster.SelectContentIDs(3, 0))).To(Equal([]int{0, 3}))
+		})
+		It("selects segments by host", func() {
+			Expect(testCluster.GetContentsMatching(cluster.SelectHosts("sdw1", "backup1"))).To(Equal([]int{0, 1, 3}))
+		})
+		It("selects segments on all hosts except the given hosts", func() {
+			Expect(testCluster.GetContentsMatching(cluster.SelectAllExceptHosts("sdw1", "mdw"))).To(Equal([]int{2, 3}))
+		})
+		It("selects segments on hosts matching a glob", func() {
+			selector, err := cluster.SelectHostsMatching("sdw*")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(testCluster.GetContentsMatching(selector)).To(Equal([]int{0, 1, 2}))
+		})
+		It("returns an error for an invalid glob", func() {
+			_, err := cluster.SelectHostsMatching("sdw[")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("Invalid host pattern sdw["))
+		})
+		It("selects segments by data directory prefix on path component boundaries", func() {
+			Expect(testCluster.GetContentsMatching(cluster.SelectDataDirPrefix("/data1"))).To(Equal([]int{0, 2}))
+			Expect(testCluster.GetContentsMatching(cluster.SelectDataDirPrefix("/data1/"))).To(Equal([]int{0, 2}))
+		})
+		It("requires segments to match all selectors given", func() {
+			Expect(testCluster.GetContentsMatching(cluster.SelectHosts("sdw1"), cluster.SelectContentIDs(1, 2))).To(Equal([]int{1}))
+		})
+		It("composes selectors with And, Or, and Not", func() {
+			onSdw1 := cluster.SelectHosts("sdw1")
+			Expect(testCluster.GetContentsMatching(onSdw1.And(cluster.SelectDataDirPrefix("/data10")))).To(Equal([]int{1}))
+			Expect(testCluster.GetContentsMatching(onSdw1.Or(cluster.SelectContentIDs(3)))).To(Equal([]int{0, 1, 3}))
+			Expect(testCluster.GetContentsMatching(cluster.Not(onSdw1))).To(Equal([]int{-1, 2, 3}))
+		})
+	})
+	Describe("command map generation with selectors", func() {
+		echoContent := func(contentID int) string {
+			return fmt.Sprintf("echo %d", contentID)
+		}
+		It("generates ssh commands only for selected segments", func() {
+			commandMap := testCluster.GenerateSSHCommandMapForSegments(false, echoContent, cluster.SelectHosts("sdw1"))
+			Expect(commandMap).To(Equal(map[int][]string{
+				0: {"ssh", "-o", "StrictHostKeyChecking=no", "testUser@sdw1", "echo 0"},
+				1: {"ssh", "-o", "StrictHostKeyChecking=no", "testUser@sdw1", "echo 1"},
+			}))
+		})
+		It("does not include the master if the scope excludes it, even if it is selected", func() {
+			commandMap := testCluster.GenerateLocalCommandMapForSegments(false, echoContent, cluster.SelectContentIDs(-1, 2))
+			Expect(commandMap).To(Equal(map[int][]string{
+				2: {"bash", "-c", "echo 2"},
+			}))
+		})
+		It("generates ssh commands only for hosts with selected segments", func() {
+			commandMap := testCluster.GenerateSSHCommandMapForHosts(true, echoContent, cluster.SelectDataDirPrefix("/data1"))
+			Expect(len(commandMap)).To(Equal(2))
+			Expect(commandMap[2]).To(Equal([]string{"ssh", "-o", "StrictHostKeyChecking=no", "testUser@sdw2", "echo 2"}))
+			Expect(commandMap[0]).To(Equal([]string{"ssh", "-o", "StrictHostKeyChecking=no", "testUser@sdw1", "echo 0"}))
+		})
+		It("generates local commands only for hosts not excluded", func() {
+			commandMap := testCluster.GenerateLocalCommandMapForHosts(true, echoContent, cluster.SelectAllExceptHosts("sdw1", "sdw2"))
+			Expect(commandMap).To(Equal(map[int][]string{
+				-1: {"bash", "-c", "echo -1"},
+				3:  {"bash", "-c", "echo 3"},
+			}))
+		})
+		It("passes selectors through GenerateAndExecuteCommand", func() {
+			testExecutor := &testhelper.TestExecutor{}
+			testCluster.Executor = testExecutor
+			testCluster.GenerateAndExecuteCommand("Running echo", echoContent, cluster.ON_MASTER_TO_SEGMENTS, cluster.SelectContentIDs(1, 3))
+			Expect(testExecutor.NumExecutions).To(Equal(1))
+			Expect(testExecutor.ClusterCommands[0]).To(Equal(map[int][]string{
+				1: {"bash", "-c", "echo 1"},
+				3: {"bash", "-c", "echo 3"},
+			}))
+		})
+	})
+})
@@ -0,0 +1,175 @@
+package dbconn
+
+/*
+ * This file contains functions related to cancelling queries running on the
+ * connections in a DBConn.
+ */
+
+import (
+	"context"
+	"sync"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+func (dbconn *DBConn) resetBackends(numConns int) {
+	dbconn.backendLock.Lock()
+	defer dbconn.backendLock.Unlock()
+	dbconn.backendPIDs = make([]int, numConns)
+	dbconn.copyConns = make([]copyConn, numConns)
+}
+
+func (dbconn *DBConn) setBackend(connNum int, pid int, conn copyConn) {
+	dbconn.backendLock.Lock()
+	defer dbconn.backendLock.Unlock()
+	if connNum < len(dbconn.backendPIDs) {
+		dbconn.backendPIDs[connNum] = pid
+		dbconn.copyConns[connNum] = conn
+	}
+}
+
+/*
+ * The driver calls this whenever it opens the given connection, including when
+ * database/sql transparently reopens a connection that was lost, so that the
+ * backend process ID and the underlying pgx connection are always current.
+ */
+func (dbconn *DBConn) recordBackend(connNum int) func(*pgx.Conn) error {
+	return func(conn *pgx.Conn) error {
+		dbconn.setBackend(connNum, int(conn.PID()), conn)
+		return nil
+	}
+}
+
+/*
+ * Returns the process ID of the server backend for the given connection, or 0
+ * if it is not known, such as when a test driver is used.
+ */
+func (dbconn *DBConn) BackendPID(whichConn ...int) int {
+	connNum := dbconn.ValidateConnNum(whichConn...)
+	return dbconn.backendPID(connNum)
+}
+
+func (dbconn *DBConn) backendPID(connNum int) int {
+	dbconn.backendLock.Lock()
+	defer dbconn.backendLock.Unlock()
+	if connNum < len(dbconn.backendPIDs) {
+		return dbconn.backendPIDs[connNum]
+	}
+	return 0
+}
+
+/*
+ * Cancel and CancelAll ask the server to cancel any query running on the given
+ * connection or on all connections, respectively, using pg_cancel_backend from
+ * a separate connection.  Like pg_cancel_backend, they succeed whether or not a
+ * query was running, and a cancelled query returns an error to its caller as
+ * usual; any transaction in progress on the connection is left aborted and must
+ * be rolled back.
+ *
+ * These are safe to call from another goroutine, such as a signal handler,
+ * while queries are running or the DBConn is being closed, so unlike other
+ * functions on a connection, Cancel returns an error instead of exiting if the
+ * connection number is invalid.
+ */
+func (dbconn *DBConn) Cancel(connNum int) error {
+	dbconn.backendLock.Lock()
+	pid := 0
+	inRange := connNum >= 0 && connNum < len(dbconn.backendPIDs)
+	if inRange {
+		pid = dbconn.backendPIDs[connNum]
+	}
+	connStr, connected := dbconn.cancelConnStr()
+	dbconn.backendLock.Unlock()
+	if !connected {
+		return errors.New("Cannot cancel queries; the database connection is not connected")
+	}
+	if !inRange {
+		return errors.Errorf("Cannot cancel query; invalid connection number: %d", connNum)
+	}
+	if pid == 0 {
+		return errors.Errorf("Cannot cancel query on connection %d; its backend process ID is unknown", connNum)
+	}
+	return dbconn.cancelBackends(connStr, []int{pid})
+}
+
+func (dbconn *DBConn) CancelAll() error {
+	dbconn.backendLock.Lock()
+	pids := make([]int, 0, len(dbconn.backendPIDs))
+	for _, pid := range dbconn.backendPIDs {
+		if pid != 0 {
+			pids = append(pids, pid)
+		}
+	}
+	connStr, connected := dbconn.cancelConnStr()
+	dbconn.backendLock.Unlock()
+	if !connected {
+		return errors.New("Cannot cancel queries; the database connection is not connected")
+	}
+	if len(pids) == 0 {
+		return nil
+	}
+	return dbconn.cancelBackends(connStr, pids)
+}
+
+/*
+ * Returns the connection string for connections outside the pool, which is
+ * last.  It must be called with backendLock held, so that it is taken together
+ * with the backend process IDs even if the DBConn is being closed at the time.
+ */
+func (dbconn *DBConn) cancelConnStr() (string, bool) {
+	if len(dbconn.connStrs) == 0 {
+		return "", false
+	}
+	return dbconn.connStrs[len(dbconn.connStrs)-1], true
+}
+
+func (dbconn *DBConn) cancelBackends(connStr string, pids []int) error {
+	conn, err := dbconn.connectDriver(context.Background(), connStr)
+	err = dbconn.handleConnectionError(err)
+	if err != nil {
+		return errors.Wrap(err, "Unable to connect to cancel queries")
+	}
+	defer conn.Close()
+	for _, pid := range pids {
+		_, err = conn.Exec("SELECT pg_cancel_backend($1)", pid)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to cancel query on backend process %d", pid)
+		}
+	}
+	return nil
+}
+
+/*
+ * Queries run with one of the "Context" functions are cancelled when their own
+ * context is done.  This function also cancels queries run without a context,
+ * by calling CancelAll once the given context is done; this makes it easy to
+ * stop all queries when a context cancelled by a signal handler is done.
+ *
+ * Calling the returned function stops watching the context without cancelling
+ * anything, and should be done before closing the DBConn.
+ */
+func (dbconn *DBConn) CancelAllOnDone(ctx context.Context) (stop func()) {
+	return cancelOnDone(ctx, dbconn.CancelAll)
+}
+
+func cancelOnDone(ctx context.Context, cancel func() error) (stop func()) {
+	stopped := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			if err := cancel(); err != nil {
+				gplog.Warn("Unable to cancel queries: %v", err)
+			}
+		case <-stopped:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stopped) })
+		<-finished
+	}
+}
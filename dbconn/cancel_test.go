@@ -0,0 +1,134 @@
+package dbconn_test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dbconn/cancel tests", func() {
+	BeforeEach(func() {
+		connection, mock = testhelper.CreateAndConnectMockDB(2)
+	})
+	Describe("DBConn.BackendPID", func() {
+		It("returns 0 if the backend process ID is not known", func() {
+			Expect(connection.BackendPID(1)).To(Equal(0))
+		})
+		It("returns the backend process ID of the given connection", func() {
+			dbconn.SetBackendPID(connection, 1, 1234)
+			Expect(connection.BackendPID()).To(Equal(0))
+			Expect(connection.BackendPID(1)).To(Equal(1234))
+		})
+		It("forgets backend process IDs when the connection is closed", func() {
+			dbconn.SetBackendPID(connection, 0, 1234)
+			connection.Close()
+			mockdb, newMock := testhelper.CreateMockDB()
+			testhelper.ExpectVersionQuery(newMock, "5.1.0")
+			connection.Driver = testhelper.TestDriver{DB: mockdb}
+			connection.MustConnect(1)
+			Expect(connection.BackendPID()).To(Equal(0))
+		})
+	})
+	Describe("DBConn.Cancel", func() {
+		It("cancels the query running on the given connection", func() {
+			dbconn.SetBackendPID(connection, 0, 1234)
+			dbconn.SetBackendPID(connection, 1, 5678)
+			mock.ExpectExec("SELECT pg_cancel_backend").WithArgs(5678).WillReturnResult(testhelper.TestResult{Rows: 1})
+
+			err := connection.Cancel(1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("returns an error if the backend process ID is not known", func() {
+			err := connection.Cancel(1)
+			Expect(err).To(MatchError("Cannot cancel query on connection 1; its backend process ID is unknown"))
+		})
+		It("returns an error if it cannot connect to cancel the query", func() {
+			dbconn.SetBackendPID(connection, 1, 5678)
+			connection.Driver = testhelper.TestDriver{ErrToReturn: fmt.Errorf("network is unreachable")}
+
+			err := connection.Cancel(1)
+			Expect(err).To(MatchError("Unable to connect to cancel queries: network is unreachable (testhost:5432)"))
+		})
+		It("returns an error if the cancel request fails", func() {
+			dbconn.SetBackendPID(connection, 1, 5678)
+			mock.ExpectExec("SELECT pg_cancel_backend").WithArgs(5678).WillReturnError(fmt.Errorf("permission denied"))
+
+			err := connection.Cancel(1)
+			Expect(err).To(MatchError("Unable to cancel query on backend process 5678: permission denied"))
+		})
+		It("returns an error if given an invalid connection number", func() {
+			err := connection.Cancel(2)
+			Expect(err).To(MatchError("Cannot cancel query; invalid connection number: 2"))
+		})
+		It("returns an error if the connection is closed", func() {
+			connection.Close()
+
+			err := connection.Cancel(0)
+			Expect(err).To(MatchError("Cannot cancel queries; the database connection is not connected"))
+		})
+	})
+	Describe("DBConn.CancelAll", func() {
+		It("cancels queries running on every connection with a known backend process ID", func() {
+			dbconn.SetBackendPID(connection, 0, 1234)
+			dbconn.SetBackendPID(connection, 1, 5678)
+			mock.ExpectExec("SELECT pg_cancel_backend").WithArgs(1234).WillReturnResult(testhelper.TestResult{Rows: 1})
+			mock.ExpectExec("SELECT pg_cancel_backend").WithArgs(5678).WillReturnResult(testhelper.TestResult{Rows: 1})
+
+			err := connection.CancelAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("does nothing if no backend process IDs are known", func() {
+			err := connection.CancelAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("returns an error if the connection is closed", func() {
+			connection.Close()
+
+			err := connection.CancelAll()
+			Expect(err).To(MatchError("Cannot cancel queries; the database connection is not connected"))
+		})
+		It("can be called while the connection is being closed", func() {
+			dbconn.SetBackendPID(connection, 0, 1234)
+			mock.MatchExpectationsInOrder(false)
+			mock.ExpectExec("SELECT pg_cancel_backend").WithArgs(1234).WillReturnResult(testhelper.TestResult{Rows: 1})
+			finished := make(chan error)
+			go func() {
+				finished <- connection.CancelAll()
+			}()
+
+			connection.Close()
+			// Whether the cancel request is sent depends on which finishes first,
+			// but CancelAll must return either way instead of panicking
+			Eventually(finished).Should(Receive())
+		})
+	})
+	Describe("DBConn.CancelAllOnDone", func() {
+		It("cancels queries when the context is done", func() {
+			dbconn.SetBackendPID(connection, 0, 1234)
+			mock.ExpectExec("SELECT pg_cancel_backend").WithArgs(1234).WillReturnResult(testhelper.TestResult{Rows: 1})
+			ctx, cancel := context.WithCancel(context.Background())
+
+			stop := connection.CancelAllOnDone(ctx)
+			cancel()
+			Eventually(mock.ExpectationsWereMet).Should(Succeed())
+			stop()
+		})
+		It("does not cancel queries once stopped", func() {
+			dbconn.SetBackendPID(connection, 0, 1234)
+			ctx, cancel := context.WithCancel(context.Background())
+
+			stop := connection.CancelAllOnDone(ctx)
+			stop()
+			cancel()
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+})
@@ -0,0 +1,428 @@
+package dbconn
+
+/*
+ * This file contains structs and functions related to building the connection
+ * string and TLS configuration used to connect to a database.
+ */
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/stdlib"
+	"github.com/pkg/errors"
+)
+
+/*
+ * These correspond to the libpq connection parameters of the same names.  An
+ * empty SSLMode means "disable", for compatibility with earlier versions of
+ * this library that never used SSL, rather than libpq's default of "prefer".
+ *
+ * If Password is empty, the password is looked up in the password file given
+ * by PGPASSFILE or in ~/.pgpass when connecting.  RuntimeParams are sent to
+ * the server as session defaults for each connection, like values passed with
+ * "-c" in PGOPTIONS, so they also apply to any connection that is reestablished;
+ * use DBConn.SetRuntimeParam to change them once connected.
+ */
+type ConnectionOptions struct {
+	Password        string
+	SSLMode         string
+	SSLRootCert     string
+	SSLCert         string
+	SSLKey          string
+	ApplicationName string
+	ConnectTimeout  int // in seconds; 0 means wait indefinitely
+	RuntimeParams   map[string]string
+}
+
+var validSSLModes = map[string]bool{
+	"disable":     true,
+	"allow":       true,
+	"prefer":      true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
+}
+
+/*
+ * Reads the options libpq reads from the environment, other than those used by
+ * NewDBConnFromEnvironment to determine the user, host, and port.
+ */
+func connectionOptionsFromEnvironment() ConnectionOptions {
+	options := ConnectionOptions{
+		Password:        operating.System.Getenv("PGPASSWORD"),
+		SSLMode:         operating.System.Getenv("PGSSLMODE"),
+		SSLRootCert:     operating.System.Getenv("PGSSLROOTCERT"),
+		SSLCert:         operating.System.Getenv("PGSSLCERT"),
+		SSLKey:          operating.System.Getenv("PGSSLKEY"),
+		ApplicationName: operating.System.Getenv("PGAPPNAME"),
+		RuntimeParams:   parsePGOptions(operating.System.Getenv("PGOPTIONS")),
+	}
+	if timeout, err := strconv.Atoi(operating.System.Getenv("PGCONNECT_TIMEOUT")); err == nil && timeout > 0 {
+		options.ConnectTimeout = timeout
+	}
+	return options
+}
+
+/*
+ * PGOPTIONS holds command-line options for the server; only options setting
+ * runtime parameters ("-c name=value", "-cname=value", or "--name=value") are
+ * meaningful for a client connection, so any others are ignored.
+ */
+func parsePGOptions(pgOptions string) map[string]string {
+	params := make(map[string]string, 0)
+	fields := strings.Fields(pgOptions)
+	for i := 0; i < len(fields); i++ {
+		var setting string
+		switch {
+		case fields[i] == "-c" && i+1 < len(fields):
+			i++
+			setting = fields[i]
+		case strings.HasPrefix(fields[i], "-c"):
+			setting = fields[i][2:]
+		case strings.HasPrefix(fields[i], "--"):
+			setting = fields[i][2:]
+		default:
+			continue
+		}
+		if pair := strings.SplitN(setting, "=", 2); len(pair) == 2 {
+			params[strings.Replace(pair[0], "-", "_", -1)] = pair[1]
+		}
+	}
+	return params
+}
+
+func (dbconn *DBConn) sslMode() string {
+	if dbconn.SSLMode == "" {
+		return "disable"
+	}
+	return dbconn.SSLMode
+}
+
+/*
+ * The connection string is a URI so that the user, password, and database name
+ * are escaped properly.  It always sets sslmode=disable, whatever the SSLMode,
+ * as pgx does not support certificate options in a connection string; instead,
+ * any TLS configuration is registered with the pgx driver by
+ * registerDriverConfigs, which pgx uses in place of the connection string's.
+ *
+ * This must be called with paramLock held, as SetRuntimeParam may change
+ * RuntimeParams from another goroutine.
+ */
+func (dbconn *DBConn) connectionString() (string, error) {
+	if !validSSLModes[dbconn.sslMode()] {
+		return "", errors.Errorf(`Invalid sslmode "%s"`, dbconn.SSLMode)
+	}
+	password, err := dbconn.getPassword()
+	if err != nil {
+		return "", err
+	}
+	connURL := url.URL{
+		Scheme: "postgres",
+		User:   url.User(dbconn.User),
+		Host:   fmt.Sprintf("%s:%d", dbconn.Host, dbconn.Port),
+		Path:   "/" + dbconn.DBName,
+	}
+	if password != "" {
+		connURL.User = url.UserPassword(dbconn.User, password)
+	}
+	params := url.Values{}
+	for name, value := range dbconn.RuntimeParams {
+		params.Set(name, value)
+	}
+	if dbconn.ApplicationName != "" {
+		params.Set("application_name", dbconn.ApplicationName)
+	}
+	if dbconn.ConnectTimeout > 0 {
+		params.Set("connect_timeout", strconv.Itoa(dbconn.ConnectTimeout))
+	}
+	/*
+	 * If the TLS configuration is registered separately, pgx uses it as long as
+	 * the connection string does not specify one, which sslmode=disable ensures.
+	 */
+	params.Set("sslmode", "disable")
+	connURL.RawQuery = params.Encode()
+	return connURL.String(), nil
+}
+
+/*
+ * Each connection in the pool is opened using its own pgx driver configuration,
+ * so that the backend process ID of a connection can be recorded whenever the
+ * driver opens it, and a separate configuration is used for connections outside
+ * the pool, such as those used to cancel queries.  If SSL may be used, these
+ * configurations also hold a TLS configuration built from the SSL options.  The
+ * registrations are removed when the DBConn is closed.
+ */
+func (dbconn *DBConn) registerDriverConfigs(connStr string, numConns int) error {
+	connConfig := pgx.ConnConfig{}
+	if dbconn.sslMode() != "disable" {
+		tlsConfig, err := dbconn.tlsConfig()
+		if err != nil {
+			return err
+		}
+		switch dbconn.sslMode() {
+		case "allow":
+			connConfig.UseFallbackTLS = true
+			connConfig.FallbackTLSConfig = tlsConfig
+		case "prefer":
+			connConfig.TLSConfig = tlsConfig
+			connConfig.UseFallbackTLS = true
+		default:
+			connConfig.TLSConfig = tlsConfig
+		}
+	}
+	dbconn.resetBackends(numConns)
+	dbconn.driverConfigs = make([]*stdlib.DriverConfig, numConns+1)
+	for i := range dbconn.driverConfigs {
+		dbconn.driverConfigs[i] = &stdlib.DriverConfig{ConnConfig: connConfig}
+		if i < numConns {
+			dbconn.driverConfigs[i].AfterConnect = dbconn.recordBackend(i)
+		}
+		stdlib.RegisterDriverConfig(dbconn.driverConfigs[i])
+	}
+	dbconn.setConnectionStrings(connStr)
+	return nil
+}
+
+/*
+ * The connection strings are guarded by backendLock, as Cancel and CancelAll
+ * may read them from another goroutine.
+ */
+func (dbconn *DBConn) setConnectionStrings(connStr string) {
+	connStrs := make([]string, len(dbconn.driverConfigs))
+	for i, driverConfig := range dbconn.driverConfigs {
+		connStrs[i] = driverConfig.ConnectionString(connStr)
+	}
+	dbconn.backendLock.Lock()
+	defer dbconn.backendLock.Unlock()
+	dbconn.connStrs = connStrs
+}
+
+func (dbconn *DBConn) connStr(connNum int) string {
+	dbconn.backendLock.Lock()
+	defer dbconn.backendLock.Unlock()
+	return dbconn.connStrs[connNum]
+}
+
+func (dbconn *DBConn) unregisterDriverConfigs() {
+	for _, driverConfig := range dbconn.driverConfigs {
+		stdlib.UnregisterDriverConfig(driverConfig)
+	}
+	dbconn.driverConfigs = nil
+	dbconn.backendLock.Lock()
+	defer dbconn.backendLock.Unlock()
+	dbconn.connStrs = nil
+}
+
+/*
+ * As in libpq, "require" only verifies the server certificate if a root
+ * certificate is given, "verify-ca" verifies the certificate chain but not the
+ * host name, and "verify-full" verifies both.  If no root certificate is given
+ * for "verify-ca" or "verify-full", the system root certificates are used.
+ */
+func (dbconn *DBConn) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	var rootCAs *x509.CertPool
+	if dbconn.SSLRootCert != "" {
+		contents, err := operating.System.ReadFile(dbconn.SSLRootCert)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to read SSL root certificate file %s", dbconn.SSLRootCert)
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(contents) {
+			return nil, errors.Errorf("Unable to parse SSL root certificate file %s", dbconn.SSLRootCert)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if dbconn.SSLCert != "" || dbconn.SSLKey != "" {
+		if dbconn.SSLCert == "" || dbconn.SSLKey == "" {
+			return nil, errors.New("Both an SSL certificate and an SSL key must be provided to use a client certificate")
+		}
+		certPEM, err := operating.System.ReadFile(dbconn.SSLCert)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to read SSL certificate file %s", dbconn.SSLCert)
+		}
+		keyPEM, err := operating.System.ReadFile(dbconn.SSLKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to read SSL key file %s", dbconn.SSLKey)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to load SSL certificate %s and key %s", dbconn.SSLCert, dbconn.SSLKey)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	mode := dbconn.sslMode()
+	if mode == "require" && rootCAs != nil {
+		mode = "verify-ca"
+	}
+	switch mode {
+	case "verify-full":
+		tlsConfig.ServerName = dbconn.Host
+	case "verify-ca":
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyCertificateChain(rawCerts, rootCAs)
+		}
+	default:
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+func verifyCertificateChain(rawCerts [][]byte, rootCAs *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("Server did not provide an SSL certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{Roots: rootCAs, Intermediates: intermediates})
+	return err
+}
+
+/*
+ * Returns the configured password, or else the first matching password in the
+ * password file, following the libpq rules for .pgpass: each line has the form
+ * hostname:port:database:username:password, any of the first four fields may
+ * be "*" to match anything, and ":" and "\" are escaped with a backslash.  A
+ * missing password file is not an error, and as in libpq, a password file that
+ * is readable by group or others is ignored with a warning.
+ */
+func (dbconn *DBConn) getPassword() (string, error) {
+	if dbconn.Password != "" {
+		return dbconn.Password, nil
+	}
+	passFile := operating.System.Getenv("PGPASSFILE")
+	if passFile == "" {
+		currentUser, err := operating.System.CurrentUser()
+		if err != nil {
+			return "", nil
+		}
+		passFile = filepath.Join(currentUser.HomeDir, ".pgpass")
+	}
+	info, err := operating.System.Stat(passFile)
+	if err != nil {
+		return "", nil
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		gplog.Warn("Password file %s has group or world access; permissions should be u=rw (0600) or less", passFile)
+		return "", nil
+	}
+	contents, err := operating.System.ReadFile(passFile)
+	if err != nil {
+		return "", nil
+	}
+	wanted := []string{dbconn.Host, strconv.Itoa(dbconn.Port), dbconn.DBName, dbconn.User}
+	scanner := bufio.NewScanner(strings.NewReader(string(contents)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := splitPgpassLine(line)
+		if len(fields) != 5 {
+			continue
+		}
+		matches := true
+		for i, value := range wanted {
+			if fields[i] != "*" && fields[i] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return fields[4], nil
+		}
+	}
+	return "", nil
+}
+
+func splitPgpassLine(line string) []string {
+	fields := make([]string, 0, 5)
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case line[i] == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
+
+/*
+ * Sets a runtime parameter, such as search_path or statement_timeout, on every
+ * connection, and records it in RuntimeParams so that it is also set on any
+ * connection that is reestablished.  The value is given as it would be in
+ * postgresql.conf, as with set_config; for example, "public, pg_catalog" for
+ * search_path.
+ *
+ * As a parameter set in a transaction reverts if the transaction is rolled
+ * back, this returns an error without changing anything if a transaction is in
+ * progress on any connection.  If setting the parameter fails on a connection,
+ * it may have been set on others, and RuntimeParams is not changed.
+ *
+ * As this uses every connection, it must not be called while another
+ * goroutine is using or reconnecting any of them, as PingAll or a health check
+ * might.  Once connected, RuntimeParams should only be changed through this
+ * function, which updates it and the connection strings built from it
+ * together under paramLock.
+ */
+func (dbconn *DBConn) MustSetRuntimeParam(name string, value string) {
+	err := dbconn.SetRuntimeParam(name, value)
+	gplog.FatalOnError(err)
+}
+
+func (dbconn *DBConn) SetRuntimeParam(name string, value string) error {
+	for connNum := 0; connNum < dbconn.NumConns; connNum++ {
+		if dbconn.Tx[connNum] != nil {
+			return errors.Errorf("Cannot set %s; there is a transaction in progress on connection %d", name, connNum)
+		}
+	}
+	for connNum := 0; connNum < dbconn.NumConns; connNum++ {
+		_, err := dbconn.ExecWithArgsOnConn(connNum, "SELECT set_config($1, $2, false)", name, value)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to set %s on connection %d", name, connNum)
+		}
+	}
+
+	dbconn.paramLock.Lock()
+	defer dbconn.paramLock.Unlock()
+	if dbconn.RuntimeParams == nil {
+		dbconn.RuntimeParams = make(map[string]string, 0)
+	}
+	dbconn.RuntimeParams[name] = value
+	if dbconn.driverConfigs != nil {
+		connStr, err := dbconn.connectionString()
+		if err != nil {
+			return err
+		}
+		dbconn.setConnectionStrings(connStr)
+	}
+	return nil
+}
@@ -0,0 +1,461 @@
+package dbconn
+
+/*
+ * This file contains structs and functions related to copying data into and
+ * out of the database with COPY.
+ */
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+/*
+ * The COPY protocol is not available through database/sql, so COPY is run on
+ * the pgx connection underlying each connection in the pool.  This interface
+ * holds the functions used, so that tests can provide their own connection.
+ */
+type copyConn interface {
+	Exec(sql string, arguments ...interface{}) (pgx.CommandTag, error)
+	CopyFromReader(r io.Reader, sql string) (pgx.CommandTag, error)
+	CopyToWriter(w io.Writer, sql string, args ...interface{}) (pgx.CommandTag, error)
+}
+
+func (dbconn *DBConn) getCopyConn(connNum int) (copyConn, error) {
+	dbconn.backendLock.Lock()
+	defer dbconn.backendLock.Unlock()
+	if dbconn.copyConns[connNum] == nil {
+		return nil, errors.Errorf("Cannot run COPY on connection %d; it is not a pgx connection", connNum)
+	}
+	return dbconn.copyConns[connNum], nil
+}
+
+/*
+ * Options for the format of copied data, which is in text format unless CSV is
+ * set.  Options left empty use the server's defaults for the format; HEADER,
+ * QUOTE, ESCAPE, and ForceQuote are only allowed in CSV format, and ForceQuote,
+ * which lists columns whose non-null values are always quoted, is only allowed
+ * when copying out of the database.
+ */
+type CopyOptions struct {
+	CSV        bool
+	Header     bool
+	Delimiter  string
+	Null       string
+	Quote      string
+	Escape     string
+	ForceQuote []string
+}
+
+/*
+ * The options are written in the syntax from before Postgres 9.0, which later
+ * versions still accept, so that they also work with GPDB 4 and 5.
+ */
+func (options CopyOptions) clause() string {
+	clause := ""
+	if options.Delimiter != "" {
+		clause += " DELIMITER AS " + copyLiteral(options.Delimiter)
+	}
+	if options.Null != "" {
+		clause += " NULL AS " + copyLiteral(options.Null)
+	}
+	if options.CSV {
+		clause += " CSV"
+	}
+	if options.Header {
+		clause += " HEADER"
+	}
+	if options.Quote != "" {
+		clause += " QUOTE AS " + copyLiteral(options.Quote)
+	}
+	if options.Escape != "" {
+		clause += " ESCAPE AS " + copyLiteral(options.Escape)
+	}
+	if len(options.ForceQuote) > 0 {
+		clause += " FORCE QUOTE " + strings.Join(options.ForceQuote, ", ")
+	}
+	return clause
+}
+
+/*
+ * Options such as the text format's default null string \N contain
+ * backslashes, so an escape string is used for those whether or not the server
+ * has standard_conforming_strings set.
+ */
+func copyLiteral(str string) string {
+	if !strings.Contains(str, `\`) {
+		return quoteLiteral(str)
+	}
+	return "E" + quoteLiteral(strings.Replace(str, `\`, `\\`, -1))
+}
+
+/*
+ * A source of data for CopyFrom in a format other than the default text format.
+ */
+type CopyData struct {
+	Reader  io.Reader
+	Options CopyOptions
+}
+
+/*
+ * A source of rows for CopyFrom; each row has a value for each column being
+ * copied.  This matches pgx.CopyFromSource, so sources written for pgx can be
+ * used as well.
+ */
+type CopyFromSource interface {
+	Next() bool
+	Values() ([]interface{}, error)
+	Err() error
+}
+
+type copyFromRows struct {
+	rows [][]interface{}
+	idx  int
+}
+
+func (source *copyFromRows) Next() bool {
+	source.idx++
+	return source.idx <= len(source.rows)
+}
+
+func (source *copyFromRows) Values() ([]interface{}, error) {
+	return source.rows[source.idx-1], nil
+}
+
+func (source *copyFromRows) Err() error {
+	return nil
+}
+
+func CopyFromRows(rows [][]interface{}) CopyFromSource {
+	return &copyFromRows{rows: rows}
+}
+
+/*
+ * Copies data into the given table, or only into the given columns if any are
+ * passed, and returns the number of rows copied.  The table and column names
+ * are used as given, so they must be quoted where necessary.
+ *
+ * The source may be an io.Reader of data in text format, a CopyData holding an
+ * io.Reader of data in another format, or a CopyFromSource of rows.
+ *
+ * Either all of the data is copied or none of it is, even if reading from the
+ * source fails partway through.  If a transaction is in progress on the
+ * connection, the data is copied as part of that transaction; if copying fails,
+ * the transaction is left as it was beforehand, so it may still be committed.
+ *
+ * As with any other function on a connection, copies on different connections
+ * may run in parallel, such as from jobs passed to RunJobs.
+ */
+func (dbconn *DBConn) CopyFrom(connNum int, table string, columns []string, source interface{}) (int64, error) {
+	return dbconn.CopyFromContext(context.Background(), connNum, table, columns, source)
+}
+
+/*
+ * If the context is done, the COPY is cancelled using Cancel; because reading
+ * from the source cannot be interrupted, the source must also be stopped if it
+ * may block.
+ */
+func (dbconn *DBConn) CopyFromContext(ctx context.Context, connNum int, table string, columns []string, source interface{}) (rows int64, err error) {
+	connNum = dbconn.ValidateConnNum(connNum)
+	var reader io.Reader
+	options := CopyOptions{}
+	switch source := source.(type) {
+	case CopyData:
+		reader = source.Reader
+		options = source.Options
+	case CopyFromSource:
+		pipeReader, pipeWriter := io.Pipe()
+		finished := make(chan struct{})
+		go func() {
+			writeCopyRows(pipeWriter, source)
+			close(finished)
+		}()
+		// If the COPY fails before reading all rows, closing the pipe stops
+		// writeCopyRows, which must finish before the caller gets the source back
+		defer func() {
+			pipeReader.Close()
+			<-finished
+		}()
+		reader = pipeReader
+	case io.Reader:
+		reader = source
+	default:
+		return 0, errors.Errorf("Cannot copy into %s from a source of type %T", table, source)
+	}
+	conn, err := dbconn.getCopyConn(connNum)
+	if err != nil {
+		return 0, err
+	}
+
+	query := "COPY " + table
+	if len(columns) > 0 {
+		query += " (" + strings.Join(columns, ", ") + ")"
+	}
+	query += " FROM STDIN" + options.clause()
+	start := operating.System.Now()
+	defer func() {
+		dbconn.logQuery(connNum, query, start, rows, err)
+	}()
+
+	/*
+	 * The COPY is run in its own transaction, or a savepoint within the current
+	 * one, so that it can be rolled back if reading from the source fails, as
+	 * the protocol would otherwise treat the end of the data read so far as the
+	 * end of the data to copy.
+	 */
+	begin, commit, rollback := "BEGIN", "COMMIT", "ROLLBACK"
+	if dbconn.Tx[connNum] != nil {
+		begin = "SAVEPOINT gp_copy_from"
+		commit = "RELEASE SAVEPOINT gp_copy_from"
+		rollback = "ROLLBACK TO SAVEPOINT gp_copy_from; RELEASE SAVEPOINT gp_copy_from"
+	}
+	_, err = conn.Exec(begin)
+	if err != nil {
+		return 0, dbconn.handleQueryError(connNum, err)
+	}
+	copyReader := &copyReader{ctx: ctx, reader: reader}
+	stop := cancelOnDone(ctx, func() error { return dbconn.Cancel(connNum) })
+	result, err := conn.CopyFromReader(copyReader, query)
+	stop()
+	if copyReader.err != nil {
+		err = copyReader.err
+	} else if err != nil {
+		err = dbconn.handleQueryError(connNum, err)
+	}
+	if err != nil {
+		_, rollbackErr := conn.Exec(rollback)
+		if rollbackErr != nil {
+			return 0, errors.Errorf("Unable to roll back COPY into %s after error %v: %v", table, err, rollbackErr)
+		}
+		return 0, err
+	}
+	_, err = conn.Exec(commit)
+	if err != nil {
+		return 0, dbconn.handleQueryError(connNum, err)
+	}
+	return result.RowsAffected(), nil
+}
+
+/*
+ * pgx takes an error from the reader as the end of the data, so the error is
+ * saved for CopyFrom to roll back the COPY instead.
+ */
+type copyReader struct {
+	ctx    context.Context
+	reader io.Reader
+	err    error
+}
+
+func (reader *copyReader) Read(buf []byte) (int, error) {
+	if reader.err == nil {
+		reader.err = reader.ctx.Err()
+	}
+	if reader.err != nil {
+		return 0, io.EOF
+	}
+	n, err := reader.reader.Read(buf)
+	if err != nil && err != io.EOF {
+		reader.err = err
+		return n, io.EOF
+	}
+	return n, err
+}
+
+/*
+ * Stops reading from the source as soon as writing fails, which happens once
+ * the pipe is closed by CopyFrom returning.  The bufio.Writer keeps returning
+ * the first error, so checking each write catches it whichever write it is.
+ */
+func writeCopyRows(pipeWriter *io.PipeWriter, source CopyFromSource) {
+	writer := bufio.NewWriter(pipeWriter)
+	for source.Next() {
+		values, err := source.Values()
+		if err != nil {
+			pipeWriter.CloseWithError(err)
+			return
+		}
+		for i, value := range values {
+			if i > 0 {
+				err = writer.WriteByte('\t')
+			}
+			var field string
+			if err == nil {
+				field, err = encodeCopyValue(value)
+			}
+			if err == nil {
+				_, err = writer.WriteString(field)
+			}
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+		}
+		if err = writer.WriteByte('\n'); err != nil {
+			pipeWriter.CloseWithError(err)
+			return
+		}
+	}
+	err := writer.Flush()
+	if err == nil {
+		err = source.Err()
+	}
+	pipeWriter.CloseWithError(err)
+}
+
+var copyTextReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+/*
+ * Encodes a value as a field in the text format.  Binary data uses the escape
+ * format for bytea instead of the hex format, which GPDB 4 and 5 do not accept.
+ */
+func encodeCopyValue(value interface{}) (string, error) {
+	if valuer, ok := value.(driver.Valuer); ok {
+		var err error
+		value, err = valuer.Value()
+		if err != nil {
+			return "", err
+		}
+	}
+	switch value := value.(type) {
+	case nil:
+		return `\N`, nil
+	case string:
+		return copyTextReplacer.Replace(value), nil
+	case []byte:
+		var field strings.Builder
+		for _, b := range value {
+			fmt.Fprintf(&field, `\\%03o`, b)
+		}
+		return field.String(), nil
+	case bool:
+		if value {
+			return "t", nil
+		}
+		return "f", nil
+	case float32:
+		return encodeCopyFloat(float64(value), 32), nil
+	case float64:
+		return encodeCopyFloat(value, 64), nil
+	case time.Time:
+		return value.Format("2006-01-02 15:04:05.999999-07:00"), nil
+	default:
+		return copyTextReplacer.Replace(fmt.Sprint(value)), nil
+	}
+}
+
+func encodeCopyFloat(value float64, bitSize int) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "Infinity"
+	case math.IsInf(value, -1):
+		return "-Infinity"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, bitSize)
+	}
+}
+
+/*
+ * Copies the rows of a table, or the results of a query, into the given writer
+ * as they are received, and returns the number of rows copied.  Anything
+ * starting with SELECT, WITH, VALUES, or an opening parenthesis is taken as a
+ * query; anything else is taken as a table name, which is used as given and so
+ * must be quoted where necessary.
+ *
+ * If a transaction is in progress on the connection, the data is read as part
+ * of that transaction, so it sees the same snapshot as other queries in it.
+ *
+ * If writing fails, the query is cancelled and the error from the writer is
+ * returned; the connection can still be used afterwards, although as with any
+ * other error, a transaction in progress must be rolled back.
+ */
+func (dbconn *DBConn) CopyTo(connNum int, queryOrTable string, writer io.Writer, options CopyOptions) (int64, error) {
+	return dbconn.CopyToContext(context.Background(), connNum, queryOrTable, writer, options)
+}
+
+/*
+ * If the context is done, the COPY is cancelled using Cancel.
+ */
+func (dbconn *DBConn) CopyToContext(ctx context.Context, connNum int, queryOrTable string, writer io.Writer, options CopyOptions) (rows int64, err error) {
+	connNum = dbconn.ValidateConnNum(connNum)
+	conn, err := dbconn.getCopyConn(connNum)
+	if err != nil {
+		return 0, err
+	}
+	source := queryOrTable
+	if isCopyQuery(queryOrTable) {
+		source = "(" + queryOrTable + ")"
+	}
+	query := "COPY " + source + " TO STDOUT" + options.clause()
+	start := operating.System.Now()
+	defer func() {
+		dbconn.logQuery(connNum, query, start, rows, err)
+	}()
+
+	copyWriter := &copyWriter{writer: writer, cancel: func() error { return dbconn.Cancel(connNum) }}
+	stop := cancelOnDone(ctx, copyWriter.cancel)
+	result, err := conn.CopyToWriter(copyWriter, query)
+	stop()
+	if copyWriter.err != nil {
+		return 0, copyWriter.err
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, dbconn.handleQueryError(connNum, err)
+	}
+	return result.RowsAffected(), nil
+}
+
+func isCopyQuery(queryOrTable string) bool {
+	trimmed := strings.TrimSpace(queryOrTable)
+	if strings.HasPrefix(trimmed, "(") {
+		return true
+	}
+	fields := strings.Fields(trimmed)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "WITH", "VALUES":
+		return true
+	}
+	return false
+}
+
+/*
+ * pgx closes the connection if writing fails, so the error is saved for CopyTo
+ * to return instead, and the rest of the data is discarded once the query has
+ * been cancelled.
+ */
+type copyWriter struct {
+	writer io.Writer
+	cancel func() error
+	err    error
+}
+
+func (writer *copyWriter) Write(buf []byte) (int, error) {
+	if writer.err != nil {
+		return len(buf), nil
+	}
+	_, err := writer.writer.Write(buf)
+	if err != nil {
+		writer.err = err
+		if cancelErr := writer.cancel(); cancelErr != nil {
+			gplog.Verbose("Unable to cancel COPY after error %v: %v", err, cancelErr)
+		}
+	}
+	return len(buf), nil
+}
@@ -0,0 +1,324 @@
+package dbconn_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+/*
+ * Records the statements it is given and the data it is sent, and sends back
+ * its data a line at a time when copying out.  It returns a command tag with
+ * the number of lines of data.  If stopEarly is set, it stops after reading the
+ * first block of data, as the server does when it rejects a row.
+ */
+type fakeCopyConn struct {
+	statements []string
+	data       string
+	copyErr    error
+	stopEarly  bool
+}
+
+func (conn *fakeCopyConn) Exec(sql string, arguments ...interface{}) (pgx.CommandTag, error) {
+	conn.statements = append(conn.statements, sql)
+	return "", nil
+}
+
+func (conn *fakeCopyConn) CopyFromReader(r io.Reader, sql string) (pgx.CommandTag, error) {
+	conn.statements = append(conn.statements, sql)
+	if conn.stopEarly {
+		buf := make([]byte, 4096)
+		n, _ := r.Read(buf)
+		conn.data = string(buf[:n])
+		return "", conn.copyErr
+	}
+	data, _ := ioutil.ReadAll(r)
+	conn.data = string(data)
+	if conn.copyErr != nil {
+		return "", conn.copyErr
+	}
+	return pgx.CommandTag(fmt.Sprintf("COPY %d", strings.Count(conn.data, "\n"))), nil
+}
+
+func (conn *fakeCopyConn) CopyToWriter(w io.Writer, sql string, args ...interface{}) (pgx.CommandTag, error) {
+	conn.statements = append(conn.statements, sql)
+	if conn.copyErr != nil {
+		return "", conn.copyErr
+	}
+	lines := strings.SplitAfter(conn.data, "\n")
+	for _, line := range lines {
+		_, err := w.Write([]byte(line))
+		if err != nil {
+			return "", err
+		}
+	}
+	return pgx.CommandTag(fmt.Sprintf("COPY %d", strings.Count(conn.data, "\n"))), nil
+}
+
+type failingWriter struct {
+	written string
+}
+
+func (writer *failingWriter) Write(buf []byte) (int, error) {
+	if writer.written != "" {
+		return 0, errors.New("write failed")
+	}
+	writer.written = string(buf)
+	return len(buf), nil
+}
+
+type failingReader struct {
+	data string
+	read bool
+}
+
+func (reader *failingReader) Read(buf []byte) (int, error) {
+	if reader.read {
+		return 0, errors.New("read failed")
+	}
+	reader.read = true
+	return copy(buf, reader.data), nil
+}
+
+type failingSource struct {
+	rowsLeft int
+}
+
+func (source *failingSource) Next() bool {
+	source.rowsLeft--
+	return true
+}
+
+func (source *failingSource) Values() ([]interface{}, error) {
+	if source.rowsLeft < 0 {
+		return nil, errors.New("no more rows")
+	}
+	return []interface{}{source.rowsLeft}, nil
+}
+
+func (source *failingSource) Err() error {
+	return nil
+}
+
+/*
+ * Returns rows forever, counting how many it has returned.
+ */
+type endlessSource struct {
+	rows int64
+}
+
+func (source *endlessSource) Next() bool {
+	atomic.AddInt64(&source.rows, 1)
+	return true
+}
+
+func (source *endlessSource) Values() ([]interface{}, error) {
+	return []interface{}{"row"}, nil
+}
+
+func (source *endlessSource) Err() error {
+	return nil
+}
+
+type testValuer struct {
+	value string
+}
+
+func (valuer testValuer) Value() (driver.Value, error) {
+	return valuer.value, nil
+}
+
+var _ = Describe("dbconn/copy tests", func() {
+	var copyConn *fakeCopyConn
+
+	BeforeEach(func() {
+		connection, mock = createAndConnectSeparateMockDB(2)
+		copyConn = &fakeCopyConn{}
+		dbconn.SetCopyConn(connection, 1, 1234, copyConn)
+	})
+	Describe("DBConn.CopyFrom", func() {
+		It("copies data in text format from a reader in its own transaction", func() {
+			rows, err := connection.CopyFrom(1, "public.foo", nil, strings.NewReader("1\tone\n2\ttwo\n"))
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rows).To(Equal(int64(2)))
+			Expect(copyConn.statements).To(Equal([]string{"BEGIN", "COPY public.foo FROM STDIN", "COMMIT"}))
+			Expect(copyConn.data).To(Equal("1\tone\n2\ttwo\n"))
+		})
+		It("copies data into the given columns in the given format", func() {
+			data := dbconn.CopyData{
+				Reader:  strings.NewReader("a,b\n1,one\n"),
+				Options: dbconn.CopyOptions{CSV: true, Header: true, Delimiter: ",", Null: `\N`, Quote: `'`, Escape: `\`},
+			}
+			_, err := connection.CopyFrom(1, "public.foo", []string{"a", "b"}, data)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(copyConn.statements[1]).To(Equal(`COPY public.foo (a, b) FROM STDIN DELIMITER AS ',' NULL AS E'\\N' CSV HEADER QUOTE AS '''' ESCAPE AS E'\\'`))
+		})
+		It("copies rows from a CopyFromSource in text format", func() {
+			timestamp := time.Date(2020, 1, 2, 3, 4, 5, 600000000, time.UTC)
+			source := dbconn.CopyFromRows([][]interface{}{
+				{1, "one", true, 1.5, nil},
+				{int64(2), "tab\tnewline\nbackslash\\", false, []byte{0, 'a', 255}, timestamp},
+				{testValuer{"valuer"}, float32(0.25), "", nil, nil},
+			})
+			rows, err := connection.CopyFrom(1, "public.foo", nil, source)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rows).To(Equal(int64(3)))
+			Expect(copyConn.data).To(Equal("1\tone\tt\t1.5\t\\N\n" +
+				`2` + "\t" + `tab\tnewline\nbackslash\\` + "\tf\t" + `\\000\\141\\377` + "\t2020-01-02 03:04:05.6+00:00\n" +
+				"valuer\t0.25\t\t\\N\t\\N\n"))
+		})
+		It("uses a savepoint if a transaction is in progress", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("SET TRANSACTION ISOLATION LEVEL SERIALIZABLE").WillReturnResult(testhelper.TestResult{})
+			connection.MustBegin(1)
+
+			_, err := connection.CopyFrom(1, "public.foo", nil, strings.NewReader("1\n"))
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(copyConn.statements).To(Equal([]string{"SAVEPOINT gp_copy_from", "COPY public.foo FROM STDIN", "RELEASE SAVEPOINT gp_copy_from"}))
+		})
+		It("rolls back and returns the error if the reader fails", func() {
+			_, err := connection.CopyFrom(1, "public.foo", nil, &failingReader{data: "1\n2"})
+
+			Expect(err).To(MatchError("read failed"))
+			Expect(copyConn.data).To(Equal("1\n2"))
+			Expect(copyConn.statements).To(Equal([]string{"BEGIN", "COPY public.foo FROM STDIN", "ROLLBACK"}))
+		})
+		It("rolls back to the savepoint and returns the error if the source fails", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("SET TRANSACTION ISOLATION LEVEL SERIALIZABLE").WillReturnResult(testhelper.TestResult{})
+			connection.MustBegin(1)
+
+			_, err := connection.CopyFrom(1, "public.foo", nil, &failingSource{rowsLeft: 2})
+
+			Expect(err).To(MatchError("no more rows"))
+			Expect(copyConn.statements[2]).To(Equal("ROLLBACK TO SAVEPOINT gp_copy_from; RELEASE SAVEPOINT gp_copy_from"))
+		})
+		It("rolls back and returns the error if the COPY fails", func() {
+			copyConn.copyErr = pgx.PgError{Severity: "ERROR", Code: "22P02", Message: "invalid input syntax for integer"}
+
+			_, err := connection.CopyFrom(1, "public.foo", nil, dbconn.CopyFromRows([][]interface{}{{"one"}}))
+
+			Expect(err).To(MatchError("ERROR: invalid input syntax for integer (SQLSTATE 22P02)"))
+			Expect(dbconn.GetPgError(err).Code).To(Equal("22P02"))
+			Expect(copyConn.statements[2]).To(Equal("ROLLBACK"))
+		})
+		It("stops reading rows from the source before returning if the COPY fails early", func() {
+			copyConn.copyErr = pgx.PgError{Severity: "ERROR", Code: "22P02", Message: "invalid input syntax for integer"}
+			copyConn.stopEarly = true
+			source := &endlessSource{}
+
+			_, err := connection.CopyFrom(1, "public.foo", nil, source)
+
+			Expect(err).To(MatchError("ERROR: invalid input syntax for integer (SQLSTATE 22P02)"))
+			rowsRead := atomic.LoadInt64(&source.rows)
+			Consistently(func() int64 { return atomic.LoadInt64(&source.rows) }, 50*time.Millisecond).Should(Equal(rowsRead))
+		})
+		It("does not copy anything if the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := connection.CopyFromContext(ctx, 1, "public.foo", nil, strings.NewReader("1\n"))
+
+			Expect(err).To(Equal(context.Canceled))
+			Expect(copyConn.data).To(Equal(""))
+			Expect(copyConn.statements[2]).To(Equal("ROLLBACK"))
+		})
+		It("returns an error for an unsupported source", func() {
+			_, err := connection.CopyFrom(1, "public.foo", nil, "1\n")
+			Expect(err).To(MatchError("Cannot copy into public.foo from a source of type string"))
+		})
+		It("returns an error if the connection is not a pgx connection", func() {
+			_, err := connection.CopyFrom(0, "public.foo", nil, strings.NewReader("1\n"))
+			Expect(err).To(MatchError("Cannot run COPY on connection 0; it is not a pgx connection"))
+		})
+	})
+	Describe("DBConn.CopyTo", func() {
+		BeforeEach(func() {
+			copyConn.data = "1,one\n2,two\n"
+		})
+		It("copies a table in text format into a writer", func() {
+			var buffer bytes.Buffer
+			rows, err := connection.CopyTo(1, "public.foo", &buffer, dbconn.CopyOptions{})
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rows).To(Equal(int64(2)))
+			Expect(buffer.String()).To(Equal("1,one\n2,two\n"))
+			Expect(copyConn.statements).To(Equal([]string{"COPY public.foo TO STDOUT"}))
+		})
+		It("copies the results of a query", func() {
+			queries := []string{
+				"SELECT * FROM public.foo",
+				"\n  select a FROM public.foo",
+				"WITH t AS (SELECT 1) SELECT * FROM t",
+				"VALUES (1), (2)",
+				"(SELECT 1) UNION (SELECT 2)",
+			}
+			for _, query := range queries {
+				var buffer bytes.Buffer
+				_, err := connection.CopyTo(1, query, &buffer, dbconn.CopyOptions{})
+
+				Expect(err).ToNot(HaveOccurred())
+				Expect(copyConn.statements[len(copyConn.statements)-1]).To(Equal("COPY (" + query + ") TO STDOUT"))
+			}
+		})
+		It("copies data in the given format", func() {
+			var buffer bytes.Buffer
+			options := dbconn.CopyOptions{CSV: true, Header: true, Delimiter: "|", Null: "NULL", Quote: `"`, ForceQuote: []string{"a", "b"}}
+			_, err := connection.CopyTo(1, "public.foo", &buffer, options)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(copyConn.statements).To(Equal([]string{`COPY public.foo TO STDOUT DELIMITER AS '|' NULL AS 'NULL' CSV HEADER QUOTE AS '"' FORCE QUOTE a, b`}))
+		})
+		It("copies data without starting a transaction", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("SET TRANSACTION ISOLATION LEVEL SERIALIZABLE").WillReturnResult(testhelper.TestResult{})
+			connection.MustBegin(1)
+			var buffer bytes.Buffer
+
+			_, err := connection.CopyTo(1, "public.foo", &buffer, dbconn.CopyOptions{})
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(copyConn.statements).To(Equal([]string{"COPY public.foo TO STDOUT"}))
+		})
+		It("returns the error from the writer if writing fails", func() {
+			dbconn.SetCopyConn(connection, 1, 0, copyConn)
+			writer := &failingWriter{}
+
+			_, err := connection.CopyTo(1, "public.foo", writer, dbconn.CopyOptions{})
+
+			Expect(err).To(MatchError("write failed"))
+			Expect(writer.written).To(Equal("1,one\n"))
+		})
+		It("returns the error if the COPY fails", func() {
+			copyConn.copyErr = pgx.PgError{Severity: "ERROR", Code: "42P01", Message: `relation "public.foo" does not exist`}
+			var buffer bytes.Buffer
+
+			_, err := connection.CopyTo(1, "public.foo", &buffer, dbconn.CopyOptions{})
+
+			Expect(dbconn.IsUndefinedObject(err)).To(BeTrue())
+		})
+		It("returns an error if the connection is not a pgx connection", func() {
+			var buffer bytes.Buffer
+			_, err := connection.CopyTo(0, "public.foo", &buffer, dbconn.CopyOptions{})
+			Expect(err).To(MatchError("Cannot run COPY on connection 0; it is not a pgx connection"))
+		})
+	})
+})
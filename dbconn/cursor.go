@@ -0,0 +1,174 @@
+package dbconn
+
+/*
+ * This file contains structs and functions related to reading large query
+ * results in batches using cursors.
+ */
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+var cursorCount int64
+
+/*
+ * A Cursor reads the results of a query from the server in batches, so that
+ * only one batch of rows is held in memory at a time, as opposed to Select,
+ * which reads all of the results at once.  It is used like sqlx.Rows:
+ *
+ *	cursor, err := connection.DeclareCursor(0, 1000, "SELECT oid, relname AS name FROM pg_class")
+ *	if err != nil { ... }
+ *	defer cursor.Close()
+ *	for cursor.Next() {
+ *		var relation Relation
+ *		err = cursor.StructScan(&relation)
+ *		...
+ *	}
+ *	err = cursor.Err()
+ *
+ * A cursor only exists within a transaction, so if no transaction is in
+ * progress on the connection when the cursor is declared, one is begun and then
+ * committed by Close.  The connection must not be used for anything else until
+ * the cursor is closed, except for other queries in the same transaction.
+ */
+type Cursor struct {
+	dbconn      *DBConn
+	ctx         context.Context
+	connNum     int
+	name        string
+	batchSize   int
+	ownTx       bool
+	rows        *sqlx.Rows
+	rowsInBatch int
+	done        bool
+	closed      bool
+	err         error
+}
+
+func (dbconn *DBConn) DeclareCursor(connNum int, batchSize int, query string, args ...interface{}) (*Cursor, error) {
+	return dbconn.DeclareCursorContext(context.Background(), connNum, batchSize, query, args...)
+}
+
+/*
+ * The context is used for declaring the cursor and fetching every batch, so
+ * reading stops with an error once it is done.
+ */
+func (dbconn *DBConn) DeclareCursorContext(ctx context.Context, connNum int, batchSize int, query string, args ...interface{}) (*Cursor, error) {
+	connNum = dbconn.ValidateConnNum(connNum)
+	if batchSize < 1 {
+		return nil, errors.Errorf("Cannot declare cursor with a batch size of %d", batchSize)
+	}
+	cursor := &Cursor{
+		dbconn:    dbconn,
+		ctx:       ctx,
+		connNum:   connNum,
+		name:      fmt.Sprintf("gp_cursor_%d", atomic.AddInt64(&cursorCount, 1)),
+		batchSize: batchSize,
+	}
+	if dbconn.Tx[connNum] == nil {
+		err := dbconn.BeginWithOptionsContext(ctx, TxOptions{}, connNum)
+		if err != nil {
+			return nil, err
+		}
+		cursor.ownTx = true
+	}
+	_, err := dbconn.ExecContextWithArgsOnConn(ctx, connNum, fmt.Sprintf("DECLARE %s CURSOR FOR %s", cursor.name, query), args...)
+	if err != nil {
+		if cursor.ownTx {
+			_ = dbconn.Rollback(connNum)
+		}
+		return nil, err
+	}
+	return cursor, nil
+}
+
+/*
+ * Advances to the next row, fetching the next batch from the server if needed,
+ * and returns false once there are no more rows or an error occurs, in which
+ * case Err returns the error.
+ */
+func (cursor *Cursor) Next() bool {
+	if cursor.closed || cursor.err != nil {
+		return false
+	}
+	for {
+		if cursor.rows != nil {
+			if cursor.rows.Next() {
+				cursor.rowsInBatch++
+				return true
+			}
+			cursor.err = cursor.rows.Err()
+			cursor.rows.Close()
+			cursor.rows = nil
+			if cursor.err != nil {
+				return false
+			}
+			if cursor.rowsInBatch < cursor.batchSize {
+				cursor.done = true
+			}
+		}
+		if cursor.done {
+			return false
+		}
+		cursor.rows, cursor.err = cursor.dbconn.QueryContextWithArgsOnConn(cursor.ctx, cursor.connNum, fmt.Sprintf("FETCH FORWARD %d FROM %s", cursor.batchSize, cursor.name))
+		if cursor.err != nil {
+			return false
+		}
+		cursor.rowsInBatch = 0
+	}
+}
+
+func (cursor *Cursor) Scan(destination ...interface{}) error {
+	if cursor.rows == nil {
+		return errors.New("Cannot scan row; there is no current row")
+	}
+	return cursor.rows.Scan(destination...)
+}
+
+/*
+ * Scans the current row into a struct as sqlx does, matching columns to fields
+ * by their "db" tags or lowercased names.
+ */
+func (cursor *Cursor) StructScan(destination interface{}) error {
+	if cursor.rows == nil {
+		return errors.New("Cannot scan row; there is no current row")
+	}
+	return cursor.rows.StructScan(destination)
+}
+
+func (cursor *Cursor) Err() error {
+	return cursor.err
+}
+
+/*
+ * Closes the cursor, and commits the transaction if it was begun for the
+ * cursor.  If reading failed, that transaction is rolled back instead, while a
+ * transaction that was already in progress is left for the caller to roll back.
+ * Calling Close more than once has no effect.
+ */
+func (cursor *Cursor) Close() error {
+	if cursor.closed {
+		return nil
+	}
+	cursor.closed = true
+	if cursor.rows != nil {
+		cursor.rows.Close()
+		cursor.rows = nil
+	}
+	if cursor.ownTx {
+		if cursor.err != nil {
+			return cursor.dbconn.Rollback(cursor.connNum)
+		}
+		return cursor.dbconn.Commit(cursor.connNum)
+	}
+	if cursor.err != nil {
+		return nil
+	}
+	_, err := cursor.dbconn.ExecWithArgsOnConn(cursor.connNum, "CLOSE "+cursor.name)
+	return err
+}
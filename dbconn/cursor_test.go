@@ -0,0 +1,148 @@
+package dbconn_test
+
+import (
+	"context"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dbconn/cursor tests", func() {
+	type relation struct {
+		Oid  uint32
+		Name string `db:"relname"`
+	}
+	fakeResult := testhelper.TestResult{Rows: 0}
+	header := []string{"oid", "relname"}
+
+	readAll := func(cursor *dbconn.Cursor) []relation {
+		relations := make([]relation, 0)
+		for cursor.Next() {
+			var rel relation
+			Expect(cursor.StructScan(&rel)).To(Succeed())
+			relations = append(relations, rel)
+		}
+		return relations
+	}
+
+	Describe("DBConn.DeclareCursor", func() {
+		It("reads rows in batches in a new transaction", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec(`DECLARE gp_cursor_\d+ CURSOR FOR SELECT oid, relname FROM pg_class WHERE relkind = \$1`).WithArgs("r").WillReturnResult(fakeResult)
+			mock.ExpectQuery(`FETCH FORWARD 2 FROM gp_cursor_\d+`).WillReturnRows(sqlmock.NewRows(header).AddRow(1, "foo").AddRow(2, "bar"))
+			mock.ExpectQuery(`FETCH FORWARD 2 FROM gp_cursor_\d+`).WillReturnRows(sqlmock.NewRows(header).AddRow(3, "baz"))
+			mock.ExpectCommit()
+
+			cursor, err := connection.DeclareCursor(0, 2, "SELECT oid, relname FROM pg_class WHERE relkind = $1", "r")
+			Expect(err).ToNot(HaveOccurred())
+			relations := readAll(cursor)
+
+			Expect(cursor.Err()).ToNot(HaveOccurred())
+			Expect(cursor.Close()).To(Succeed())
+			Expect(relations).To(Equal([]relation{{1, "foo"}, {2, "bar"}, {3, "baz"}}))
+			Expect(connection.Tx[0]).To(BeNil())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("fetches until a batch is empty if every batch is full", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec(`DECLARE gp_cursor_\d+ CURSOR FOR SELECT oid FROM pg_class`).WillReturnResult(fakeResult)
+			mock.ExpectQuery(`FETCH FORWARD 1 FROM gp_cursor_\d+`).WillReturnRows(sqlmock.NewRows([]string{"oid"}).AddRow(1))
+			mock.ExpectQuery(`FETCH FORWARD 1 FROM gp_cursor_\d+`).WillReturnRows(sqlmock.NewRows([]string{"oid"}))
+			mock.ExpectCommit()
+
+			cursor, err := connection.DeclareCursor(0, 1, "SELECT oid FROM pg_class")
+			Expect(err).ToNot(HaveOccurred())
+			oids := make([]uint32, 0)
+			for cursor.Next() {
+				var oid uint32
+				Expect(cursor.Scan(&oid)).To(Succeed())
+				oids = append(oids, oid)
+			}
+
+			Expect(cursor.Close()).To(Succeed())
+			Expect(oids).To(Equal([]uint32{1}))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("uses the transaction in progress and closes the cursor", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("SET TRANSACTION ISOLATION LEVEL SERIALIZABLE").WillReturnResult(fakeResult)
+			mock.ExpectExec(`DECLARE gp_cursor_\d+ CURSOR FOR SELECT oid, relname FROM pg_class`).WillReturnResult(fakeResult)
+			mock.ExpectQuery(`FETCH FORWARD 10 FROM gp_cursor_\d+`).WillReturnRows(sqlmock.NewRows(header).AddRow(1, "foo"))
+			mock.ExpectExec(`CLOSE gp_cursor_\d+`).WillReturnResult(fakeResult)
+			connection.MustBegin()
+
+			cursor, err := connection.DeclareCursor(0, 10, "SELECT oid, relname FROM pg_class")
+			Expect(err).ToNot(HaveOccurred())
+			relations := readAll(cursor)
+
+			Expect(cursor.Close()).To(Succeed())
+			Expect(relations).To(Equal([]relation{{1, "foo"}}))
+			Expect(connection.Tx[0]).ToNot(BeNil())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("stops and rolls back its transaction if fetching fails", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec(`DECLARE gp_cursor_\d+ CURSOR FOR SELECT oid, relname FROM pg_class`).WillReturnResult(fakeResult)
+			mock.ExpectQuery(`FETCH FORWARD 1 FROM gp_cursor_\d+`).WillReturnRows(sqlmock.NewRows(header).AddRow(1, "foo"))
+			mock.ExpectQuery(`FETCH FORWARD 1 FROM gp_cursor_\d+`).WillReturnError(errors.New("fetch failed"))
+			mock.ExpectRollback()
+
+			cursor, err := connection.DeclareCursor(0, 1, "SELECT oid, relname FROM pg_class")
+			Expect(err).ToNot(HaveOccurred())
+			relations := readAll(cursor)
+
+			Expect(relations).To(Equal([]relation{{1, "foo"}}))
+			Expect(cursor.Err()).To(MatchError("fetch failed"))
+			Expect(cursor.Next()).To(BeFalse())
+			Expect(cursor.Close()).To(Succeed())
+			Expect(connection.Tx[0]).To(BeNil())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("stops fetching once the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			mock.ExpectBegin()
+			mock.ExpectExec(`DECLARE gp_cursor_\d+ CURSOR FOR SELECT oid, relname FROM pg_class`).WillReturnResult(fakeResult)
+			mock.ExpectQuery(`FETCH FORWARD 1 FROM gp_cursor_\d+`).WillReturnRows(sqlmock.NewRows(header).AddRow(1, "foo"))
+			mock.ExpectRollback()
+
+			cursor, err := connection.DeclareCursorContext(ctx, 0, 1, "SELECT oid, relname FROM pg_class")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cursor.Next()).To(BeTrue())
+			cancel()
+
+			Expect(cursor.Next()).To(BeFalse())
+			Expect(cursor.Err()).To(HaveOccurred())
+			Expect(cursor.Close()).To(Succeed())
+		})
+		It("rolls back its transaction if declaring the cursor fails", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec(`DECLARE gp_cursor_\d+ CURSOR FOR SELECT nothing`).WillReturnError(errors.New("syntax error"))
+			mock.ExpectRollback()
+
+			_, err := connection.DeclareCursor(0, 1, "SELECT nothing")
+
+			Expect(err).To(MatchError("syntax error"))
+			Expect(connection.Tx[0]).To(BeNil())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("returns an error if the batch size is not positive", func() {
+			_, err := connection.DeclareCursor(0, 0, "SELECT oid FROM pg_class")
+			Expect(err).To(MatchError("Cannot declare cursor with a batch size of 0"))
+		})
+		It("returns an error when scanning without a current row", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec(`DECLARE gp_cursor_\d+ CURSOR FOR SELECT oid FROM pg_class`).WillReturnResult(fakeResult)
+
+			cursor, err := connection.DeclareCursor(0, 1, "SELECT oid FROM pg_class")
+			Expect(err).ToNot(HaveOccurred())
+
+			var oid uint32
+			Expect(cursor.Scan(&oid)).To(MatchError("Cannot scan row; there is no current row"))
+		})
+	})
+})
@@ -8,9 +8,9 @@ package dbconn
 import (
 	"context"
 	"database/sql"
-	"fmt"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/greenplum-db/gp-common-go-libs/gplog"
 	"github.com/greenplum-db/gp-common-go-libs/operating"
@@ -20,7 +20,7 @@ import (
 	 * but it had a bug with the way it handled certain encodings.
 	 * pgx seems to handle these encodings properly.
 	 */
-	_ "github.com/jackc/pgx/stdlib"
+	"github.com/jackc/pgx/stdlib"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 )
@@ -36,10 +36,25 @@ import (
  * exactly one database connection each) in an array, such that callers can
  * create NumConns goroutines and assign each an index from 0 to NumConns to
  * guarantee that each goroutine gets its own connection that exhibits single-
- * session behavior.  The Exec, Select, and Get functions are set up to default
- * to the first connection (index 0), so the DBConn will still exhibit session-
- * like behavior if no connection is specified, and other functions that want to
- * execute in serial should pass in a 0 wherever a connection number is needed.
+ * session behavior (RunJobs does this for a list of jobs).  The Exec, Select,
+ * and Get functions are set up to default to the first connection (index 0),
+ * so the DBConn will still exhibit session-like behavior if no connection is
+ * specified, and other functions that want to execute in serial should pass in
+ * a 0 wherever a connection number is needed.
+ *
+ * Options such as the password and SSL settings are held in the embedded
+ * ConnectionOptions, and may be set at any time before calling Connect, while
+ * the ReconnectPolicy may be changed at any time.
+ *
+ * Setting LogQueries logs every statement at the Debug level along with how
+ * long it took, and a statement that takes at least SlowQueryThreshold, if it
+ * is set, is logged at the Warn level whether or not LogQueries is set.  The
+ * QueryHook, if any, is called after every statement.  These should be set
+ * before running any statements in parallel.
+ *
+ * OnConnect and OnClose, if set, are called with the connection number and its
+ * backend process ID (see BackendPID) whenever a connection is opened or closed,
+ * including by Reconnect, and Stats reports what each connection has done.
  */
 type DBConn struct {
 	ConnPool []*sqlx.DB
@@ -51,6 +66,23 @@ type DBConn struct {
 	Port     int
 	Tx       []*sqlx.Tx
 	Version  GPDBVersion
+	ConnectionOptions
+	ReconnectPolicy ReconnectPolicy
+
+	LogQueries         bool
+	SlowQueryThreshold time.Duration
+	QueryHook          QueryHook
+	OnConnect          func(connNum int, backendPID int)
+	OnClose            func(connNum int, backendPID int)
+
+	driverConfigs []*stdlib.DriverConfig
+	connStrs      []string // one for each connection, then one for connections outside the pool
+	backendPIDs   []int
+	copyConns     []copyConn
+	backendLock   sync.Mutex
+	connStats     []ConnStats
+	statsLock     sync.Mutex
+	paramLock     sync.Mutex
 }
 
 /*
@@ -91,7 +123,9 @@ func NewDBConnFromEnvironment(dbname string) *DBConn {
 		port = 5432
 	}
 
-	return NewDBConn(dbname, username, host, port)
+	connection := NewDBConn(dbname, username, host, port)
+	connection.ConnectionOptions = connectionOptionsFromEnvironment()
+	return connection
 }
 
 func NewDBConn(dbname, username, host string, port int) *DBConn {
@@ -126,30 +160,38 @@ func (dbconn *DBConn) MustBegin(whichConn ...int) {
 }
 
 func (dbconn *DBConn) Begin(whichConn ...int) error {
-	connNum := dbconn.ValidateConnNum(whichConn...)
-	if dbconn.Tx[connNum] != nil {
-		return errors.New("Cannot begin transaction; there is already a transaction in progress")
-	}
-	var err error
-	dbconn.Tx[connNum], err = dbconn.ConnPool[connNum].Beginx()
-	if err != nil {
-		return err
-	}
-	_, err = dbconn.Exec("SET TRANSACTION ISOLATION LEVEL SERIALIZABLE", connNum)
-	return err
+	return dbconn.BeginContext(context.Background(), whichConn...)
+}
+
+func (dbconn *DBConn) MustBeginContext(ctx context.Context, whichConn ...int) {
+	err := dbconn.BeginContext(ctx, whichConn...)
+	gplog.FatalOnError(err)
+}
+
+/*
+ * As with database/sql, if the context is done before the transaction is
+ * committed, the transaction is rolled back, and a later Commit or Rollback
+ * returns an error.
+ */
+func (dbconn *DBConn) BeginContext(ctx context.Context, whichConn ...int) error {
+	return dbconn.BeginWithOptionsContext(ctx, TxOptions{Isolation: sql.LevelSerializable}, whichConn...)
 }
 
 func (dbconn *DBConn) Close() {
 	if dbconn.ConnPool != nil {
-		for _, conn := range dbconn.ConnPool {
+		for connNum, conn := range dbconn.ConnPool {
 			if conn != nil {
+				backendPID := dbconn.backendPID(connNum)
 				_ = conn.Close()
+				dbconn.connectionClosed(connNum, backendPID)
 			}
 		}
 		dbconn.ConnPool = nil
 		dbconn.Tx = nil
 		dbconn.NumConns = 0
 	}
+	dbconn.unregisterDriverConfigs()
+	dbconn.resetBackends(0)
 }
 
 func (dbconn *DBConn) MustCommit(whichConn ...int) {
@@ -163,7 +205,7 @@ func (dbconn *DBConn) Commit(whichConn ...int) error {
 		return errors.New("Cannot commit transaction; there is no transaction in progress")
 	}
 	err := dbconn.Tx[connNum].Commit()
-	dbconn.Tx[connNum] = nil
+	dbconn.setTx(connNum, nil)
 	return err
 }
 
@@ -178,7 +220,7 @@ func (dbconn *DBConn) Rollback(whichConn ...int) error {
 		return errors.New("Cannot rollback transaction; there is no transaction in progress")
 	}
 	err := dbconn.Tx[connNum].Rollback()
-	dbconn.Tx[connNum] = nil
+	dbconn.setTx(connNum, nil)
 	return err
 }
 
@@ -188,29 +230,52 @@ func (dbconn *DBConn) MustConnect(numConns int) {
 }
 
 func (dbconn *DBConn) Connect(numConns int) error {
+	return dbconn.ConnectContext(context.Background(), numConns)
+}
+
+func (dbconn *DBConn) MustConnectContext(ctx context.Context, numConns int) {
+	err := dbconn.ConnectContext(ctx, numConns)
+	gplog.FatalOnError(err)
+}
+
+/*
+ * If the context is done before all connections are made, ConnectContext
+ * returns without waiting for the current connection attempt to finish; the
+ * DBConn must then be closed before it is reused.
+ */
+func (dbconn *DBConn) ConnectContext(ctx context.Context, numConns int) error {
 	if numConns < 1 {
 		return errors.Errorf("Must specify a connection pool size that is a positive integer")
 	}
 	if dbconn.ConnPool != nil {
 		return errors.Errorf("The database connection must be closed before reusing the connection")
 	}
-	// This string takes in the literal user/database names. They do not need to be escaped or quoted.
-	connStr := fmt.Sprintf("postgres://%s@%s:%d/%s?sslmode=disable", dbconn.User, dbconn.Host, dbconn.Port, dbconn.DBName)
+	dbconn.paramLock.Lock()
+	connStr, err := dbconn.connectionString()
+	dbconn.paramLock.Unlock()
+	if err != nil {
+		return err
+	}
+	err = dbconn.registerDriverConfigs(connStr, numConns)
+	if err != nil {
+		return err
+	}
 
+	dbconn.resetStats(numConns)
 	dbconn.ConnPool = make([]*sqlx.DB, numConns)
 	for i := 0; i < numConns; i++ {
-		conn, err := dbconn.Driver.Connect("pgx", connStr)
+		conn, err := dbconn.connectDriver(ctx, dbconn.connStr(i))
 		err = dbconn.handleConnectionError(err)
 		if err != nil {
 			return err
 		}
 		conn.SetMaxOpenConns(1)
 		conn.SetMaxIdleConns(1)
-		dbconn.ConnPool[i] = conn
+		dbconn.connectionOpened(i, conn)
 	}
 	dbconn.Tx = make([]*sqlx.Tx, numConns)
 	dbconn.NumConns = numConns
-	version, err := InitializeVersion(dbconn)
+	version, err := initializeVersion(ctx, dbconn)
 	if err != nil {
 		return errors.Wrap(err, "Failed to determine database version")
 	}
@@ -218,24 +283,35 @@ func (dbconn *DBConn) Connect(numConns int) error {
 	return nil
 }
 
-func (dbconn *DBConn) handleConnectionError(err error) error {
-	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") {
-			if strings.Contains(err.Error(), "pq: role") {
-				return errors.Errorf(`Role "%s" does not exist on %s:%d, exiting`, dbconn.User, dbconn.Host, dbconn.Port)
-			} else if strings.Contains(err.Error(), "pq: database") {
-				return errors.Errorf(`Database "%s" does not exist on %s:%d, exiting`, dbconn.DBName, dbconn.Host, dbconn.Port)
+/*
+ * DBDriver.Connect cannot be interrupted, so the connection attempt is made in
+ * the background, and a connection that completes after the context is done is
+ * closed as soon as it is made.
+ */
+func (dbconn *DBConn) connectDriver(ctx context.Context, connStr string) (*sqlx.DB, error) {
+	type connectResult struct {
+		conn *sqlx.DB
+		err  error
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	finished := make(chan connectResult, 1)
+	go func() {
+		conn, err := dbconn.Driver.Connect("pgx", connStr)
+		finished <- connectResult{conn, err}
+	}()
+	select {
+	case result := <-finished:
+		return result.conn, result.err
+	case <-ctx.Done():
+		go func() {
+			if result := <-finished; result.conn != nil {
+				_ = result.conn.Close()
 			}
-		} else if strings.Contains(err.Error(), "connection refused") {
-			return errors.Errorf(`could not connect to server: Connection refused
-	Is the server running on host "%s" and accepting
-	TCP/IP connections on port %d?`, dbconn.Host, dbconn.Port)
-		} else {
-			return errors.Errorf("%v (%s:%d)", err, dbconn.Host, dbconn.Port)
-		}
+		}()
+		return nil, ctx.Err()
 	}
-
-	return err
 }
 
 /*
@@ -243,14 +319,30 @@ func (dbconn *DBConn) handleConnectionError(err error) error {
  * automatically execute the query as part of an existing transaction if one is
  * in progress, to ensure that successive queries occur in one transaction without
  * requiring that to be ensured at the call site.
+ *
+ * Each operation has a basic form that takes only a query string and an
+ * optional connection number, a "Context" form that also takes a context, and
+ * a "WithArgsOnConn" form that takes bind arguments and an explicit connection
+ * number, with a "ContextWithArgsOnConn" variant of the latter that all of the
+ * others are implemented in terms of.  The older "WithArgs" forms always use
+ * the first connection.
  */
 
-func (dbconn *DBConn) Exec(query string, whichConn ...int) (sql.Result, error) {
-	connNum := dbconn.ValidateConnNum(whichConn...)
+/*
+ * Returns the transaction in progress on the given connection if there is one,
+ * or the connection itself if not.
+ */
+func (dbconn *DBConn) queryer(connNum int) sqlx.ExtContext {
+	connNum = dbconn.ValidateConnNum(connNum)
 	if dbconn.Tx[connNum] != nil {
-		return dbconn.Tx[connNum].Exec(query)
+		return dbconn.Tx[connNum]
 	}
-	return dbconn.ConnPool[connNum].Exec(query)
+	return dbconn.ConnPool[connNum]
+}
+
+func (dbconn *DBConn) Exec(query string, whichConn ...int) (sql.Result, error) {
+	connNum := dbconn.ValidateConnNum(whichConn...)
+	return dbconn.ExecWithArgsOnConn(connNum, query)
 }
 
 func (dbconn *DBConn) MustExec(query string, whichConn ...int) {
@@ -260,10 +352,7 @@ func (dbconn *DBConn) MustExec(query string, whichConn ...int) {
 
 func (dbconn *DBConn) ExecContext(queryContext context.Context, query string, whichConn ...int) (sql.Result, error) {
 	connNum := dbconn.ValidateConnNum(whichConn...)
-	if dbconn.Tx[connNum] != nil {
-		return dbconn.Tx[connNum].ExecContext(queryContext, query)
-	}
-	return dbconn.ConnPool[connNum].ExecContext(queryContext, query)
+	return dbconn.ExecContextWithArgsOnConn(queryContext, connNum, query)
 }
 
 func (dbconn *DBConn) MustExecContext(queryContext context.Context, query string, whichConn ...int) {
@@ -271,49 +360,110 @@ func (dbconn *DBConn) MustExecContext(queryContext context.Context, query string
 	gplog.FatalOnError(err)
 }
 
-func (dbconn *DBConn) GetWithArgs(destination interface{}, query string, args ...interface{}) error {
-	if dbconn.Tx[0] != nil {
-		return dbconn.Tx[0].Get(destination, query, args...)
+func (dbconn *DBConn) ExecWithArgs(query string, args ...interface{}) (sql.Result, error) {
+	return dbconn.ExecWithArgsOnConn(0, query, args...)
+}
+
+func (dbconn *DBConn) ExecWithArgsOnConn(connNum int, query string, args ...interface{}) (sql.Result, error) {
+	return dbconn.ExecContextWithArgsOnConn(context.Background(), connNum, query, args...)
+}
+
+func (dbconn *DBConn) MustExecWithArgsOnConn(connNum int, query string, args ...interface{}) {
+	_, err := dbconn.ExecWithArgsOnConn(connNum, query, args...)
+	gplog.FatalOnError(err)
+}
+
+func (dbconn *DBConn) ExecContextWithArgsOnConn(queryContext context.Context, connNum int, query string, args ...interface{}) (sql.Result, error) {
+	start := operating.System.Now()
+	result, err := dbconn.queryer(connNum).ExecContext(queryContext, query, args...)
+	err = dbconn.handleQueryError(connNum, err)
+	rowsAffected := int64(-1)
+	if err == nil {
+		if numRows, rowsErr := result.RowsAffected(); rowsErr == nil {
+			rowsAffected = numRows
+		}
 	}
-	return dbconn.ConnPool[0].Get(destination, query, args...)
+	dbconn.logQuery(connNum, query, start, rowsAffected, err)
+	return result, err
+}
+
+func (dbconn *DBConn) GetWithArgs(destination interface{}, query string, args ...interface{}) error {
+	return dbconn.GetWithArgsOnConn(0, destination, query, args...)
 }
 
 func (dbconn *DBConn) Get(destination interface{}, query string, whichConn ...int) error {
 	connNum := dbconn.ValidateConnNum(whichConn...)
-	if dbconn.Tx[connNum] != nil {
-		return dbconn.Tx[connNum].Get(destination, query)
-	}
-	return dbconn.ConnPool[connNum].Get(destination, query)
+	return dbconn.GetWithArgsOnConn(connNum, destination, query)
+}
+
+func (dbconn *DBConn) GetContext(queryContext context.Context, destination interface{}, query string, whichConn ...int) error {
+	connNum := dbconn.ValidateConnNum(whichConn...)
+	return dbconn.GetContextWithArgsOnConn(queryContext, connNum, destination, query)
+}
+
+func (dbconn *DBConn) GetWithArgsOnConn(connNum int, destination interface{}, query string, args ...interface{}) error {
+	return dbconn.GetContextWithArgsOnConn(context.Background(), connNum, destination, query, args...)
+}
+
+func (dbconn *DBConn) GetContextWithArgsOnConn(queryContext context.Context, connNum int, destination interface{}, query string, args ...interface{}) error {
+	start := operating.System.Now()
+	err := sqlx.GetContext(queryContext, dbconn.queryer(connNum), destination, query, args...)
+	err = dbconn.handleQueryError(connNum, err)
+	dbconn.logQuery(connNum, query, start, 1, err)
+	return err
 }
 
 func (dbconn *DBConn) SelectWithArgs(destination interface{}, query string, args ...interface{}) error {
-	if dbconn.Tx[0] != nil {
-		return dbconn.Tx[0].Select(destination, query, args...)
-	}
-	return dbconn.ConnPool[0].Select(destination, query, args...)
+	return dbconn.SelectWithArgsOnConn(0, destination, query, args...)
 }
 
 func (dbconn *DBConn) Select(destination interface{}, query string, whichConn ...int) error {
 	connNum := dbconn.ValidateConnNum(whichConn...)
-	if dbconn.Tx[connNum] != nil {
-		return dbconn.Tx[connNum].Select(destination, query)
-	}
-	return dbconn.ConnPool[connNum].Select(destination, query)
+	return dbconn.SelectWithArgsOnConn(connNum, destination, query)
+}
+
+func (dbconn *DBConn) SelectContext(queryContext context.Context, destination interface{}, query string, whichConn ...int) error {
+	connNum := dbconn.ValidateConnNum(whichConn...)
+	return dbconn.SelectContextWithArgsOnConn(queryContext, connNum, destination, query)
+}
+
+func (dbconn *DBConn) SelectWithArgsOnConn(connNum int, destination interface{}, query string, args ...interface{}) error {
+	return dbconn.SelectContextWithArgsOnConn(context.Background(), connNum, destination, query, args...)
+}
+
+func (dbconn *DBConn) SelectContextWithArgsOnConn(queryContext context.Context, connNum int, destination interface{}, query string, args ...interface{}) error {
+	start := operating.System.Now()
+	lenBefore := sliceLen(destination)
+	err := sqlx.SelectContext(queryContext, dbconn.queryer(connNum), destination, query, args...)
+	err = dbconn.handleQueryError(connNum, err)
+	dbconn.logQuery(connNum, query, start, sliceLen(destination)-lenBefore, err)
+	return err
 }
 
 func (dbconn *DBConn) QueryWithArgs(query string, args ...interface{}) (*sqlx.Rows, error) {
-	if dbconn.Tx[0] != nil {
-		return dbconn.Tx[0].Queryx(query, args...)
-	}
-	return dbconn.ConnPool[0].Queryx(query, args...)
+	return dbconn.QueryWithArgsOnConn(0, query, args...)
 }
 
 func (dbconn *DBConn) Query(query string, whichConn ...int) (*sqlx.Rows, error) {
 	connNum := dbconn.ValidateConnNum(whichConn...)
-	if dbconn.Tx[connNum] != nil {
-		return dbconn.Tx[connNum].Queryx(query)
-	}
-	return dbconn.ConnPool[connNum].Queryx(query)
+	return dbconn.QueryWithArgsOnConn(connNum, query)
+}
+
+func (dbconn *DBConn) QueryContext(queryContext context.Context, query string, whichConn ...int) (*sqlx.Rows, error) {
+	connNum := dbconn.ValidateConnNum(whichConn...)
+	return dbconn.QueryContextWithArgsOnConn(queryContext, connNum, query)
+}
+
+func (dbconn *DBConn) QueryWithArgsOnConn(connNum int, query string, args ...interface{}) (*sqlx.Rows, error) {
+	return dbconn.QueryContextWithArgsOnConn(context.Background(), connNum, query, args...)
+}
+
+func (dbconn *DBConn) QueryContextWithArgsOnConn(queryContext context.Context, connNum int, query string, args ...interface{}) (*sqlx.Rows, error) {
+	start := operating.System.Now()
+	rows, err := dbconn.queryer(connNum).QueryxContext(queryContext, query, args...)
+	err = dbconn.handleQueryError(connNum, err)
+	dbconn.logQuery(connNum, query, start, -1, err)
+	return rows, err
 }
 
 /*
@@ -351,14 +501,25 @@ func MustSelectString(connection *DBConn, query string, whichConn ...int) string
 }
 
 func SelectString(connection *DBConn, query string, whichConn ...int) (string, error) {
-	results, err := SelectStringSlice(connection, query, whichConn...)
+	return SelectStringContext(context.Background(), connection, query, whichConn...)
+}
+
+func MustSelectStringContext(ctx context.Context, connection *DBConn, query string, whichConn ...int) string {
+	str, err := SelectStringContext(ctx, connection, query, whichConn...)
+	gplog.FatalOnError(err)
+	return str
+}
+
+func SelectStringContext(ctx context.Context, connection *DBConn, query string, whichConn ...int) (string, error) {
+	results, err := SelectStringSliceContext(ctx, connection, query, whichConn...)
 	if err != nil {
 		return "", err
 	}
+	if err = checkSingleRow(len(results)); err != nil {
+		return "", err
+	}
 	if len(results) == 1 {
 		return results[0], nil
-	} else if len(results) > 1 {
-		return "", errors.Errorf("Too many rows returned from query: got %d rows, expected 1 row", len(results))
 	}
 	return "", nil
 }
@@ -381,25 +542,26 @@ func MustSelectStringSlice(connection *DBConn, query string, whichConn ...int) [
 }
 
 func SelectStringSlice(connection *DBConn, query string, whichConn ...int) ([]string, error) {
+	return SelectStringSliceContext(context.Background(), connection, query, whichConn...)
+}
+
+func MustSelectStringSliceContext(ctx context.Context, connection *DBConn, query string, whichConn ...int) []string {
+	str, err := SelectStringSliceContext(ctx, connection, query, whichConn...)
+	gplog.FatalOnError(err)
+	return str
+}
+
+func SelectStringSliceContext(ctx context.Context, connection *DBConn, query string, whichConn ...int) ([]string, error) {
 	connNum := connection.ValidateConnNum(whichConn...)
-	rows, err := connection.Query(query, connNum)
-	if err != nil {
-		return []string{}, err
-	}
-	if cols, _ := rows.Rows.Columns(); len(cols) > 1 {
-		return []string{}, errors.Errorf("Too many columns returned from query: got %d columns, expected 1 column", len(cols))
-	}
 	retval := make([]string, 0)
-	for rows.Rows.Next() {
+	err := selectColumnContext(ctx, connection, query, connNum, func(rows *sql.Rows) error {
 		var result sql.NullString
-		err = rows.Rows.Scan(&result)
-		if err != nil {
-			return []string{}, err
-		}
+		err := rows.Scan(&result)
 		retval = append(retval, result.String)
-	}
-	if rows.Rows.Err() != nil {
-		return []string{}, rows.Rows.Err()
+		return err
+	})
+	if err != nil {
+		return []string{}, err
 	}
 	return retval, nil
 }
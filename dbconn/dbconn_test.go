@@ -4,7 +4,9 @@ import (
 	"context"
 	"database/sql/driver"
 	"fmt"
+	"net"
 	"os"
+	"syscall"
 	"testing"
 	"time"
 
@@ -13,6 +15,7 @@ import (
 	"github.com/greenplum-db/gp-common-go-libs/operating"
 	"github.com/greenplum-db/gp-common-go-libs/testhelper"
 
+	"github.com/jackc/pgx"
 	"github.com/jmoiron/sqlx"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -29,6 +32,47 @@ func ExpectBegin(mock sqlmock.Sqlmock) {
 	mock.ExpectExec("SET TRANSACTION(.*)").WillReturnResult(fakeResult)
 }
 
+/*
+ * Blocks each connection attempt until unblock is closed, to simulate an
+ * unreachable host.
+ */
+type blockingDriver struct {
+	testhelper.TestDriver
+	unblock chan struct{}
+}
+
+func (driver blockingDriver) Connect(driverName string, dataSourceName string) (*sqlx.DB, error) {
+	<-driver.unblock
+	return driver.TestDriver.Connect(driverName, dataSourceName)
+}
+
+/*
+ * TestDriver returns the same sqlx.DB for every connection, which only allows
+ * one transaction at a time, so this driver opens a separate sqlx.DB for each
+ * connection that shares the same mock.
+ */
+type separateConnDriver struct {
+	dsn string
+}
+
+func (driver separateConnDriver) Connect(driverName string, dataSourceName string) (*sqlx.DB, error) {
+	return sqlx.Open("sqlmock", driver.dsn)
+}
+
+var mockDSNCount = 0
+
+func createAndConnectSeparateMockDB(numConns int) (*dbconn.DBConn, sqlmock.Sqlmock) {
+	mockDSNCount++
+	dsn := fmt.Sprintf("separate_conn_mock_%d", mockDSNCount)
+	_, newMock, err := sqlmock.NewWithDSN(dsn)
+	Expect(err).ToNot(HaveOccurred())
+	newConnection := dbconn.NewDBConn("testdb", "testrole", "testhost", 5432)
+	newConnection.Driver = separateConnDriver{dsn: dsn}
+	testhelper.ExpectVersionQuery(newMock, "5.1.0")
+	newConnection.MustConnect(numConns)
+	return newConnection, newMock
+}
+
 func TestDBConn(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "dbconn tests")
@@ -98,7 +142,8 @@ var _ = Describe("dbconn/dbconn tests", func() {
 			Expect(len(connection.Tx)).To(Equal(3))
 		})
 		It("does not connect if the database exists but the connection is refused", func() {
-			connection.Driver = testhelper.TestDriver{ErrToReturn: fmt.Errorf("pq: connection refused"), DB: mockdb, User: "testrole"}
+			connectionRefused := &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}
+			connection.Driver = testhelper.TestDriver{ErrToReturn: connectionRefused, DB: mockdb, User: "testrole"}
 			defer testhelper.ShouldPanicWithMessage(`could not connect to server: Connection refused`)
 			connection.MustConnect(1)
 		})
@@ -107,7 +152,7 @@ var _ = Describe("dbconn/dbconn tests", func() {
 			connection.MustConnect(0)
 		})
 		It("fails if the database does not exist", func() {
-			connection.Driver = testhelper.TestDriver{ErrToReturn: fmt.Errorf("pq: database \"testdb\" does not exist"), DB: mockdb, DBName: "testdb", User: "testrole"}
+			connection.Driver = testhelper.TestDriver{ErrToReturn: pgx.PgError{Severity: "FATAL", Code: "3D000", Message: `database "testdb" does not exist`}, DB: mockdb, DBName: "testdb", User: "testrole"}
 			Expect(connection.DBName).To(Equal("testdb"))
 			defer testhelper.ShouldPanicWithMessage("Database \"testdb\" does not exist on testhost:5432, exiting")
 			connection.MustConnect(1)
@@ -118,13 +163,42 @@ var _ = Describe("dbconn/dbconn tests", func() {
 			defer os.Setenv("PGUSER", oldPgUser)
 
 			connection = dbconn.NewDBConnFromEnvironment("testdb")
-			connection.Driver = testhelper.TestDriver{ErrToReturn: fmt.Errorf("pq: role \"nonexistent\" does not exist"), DB: mockdb, DBName: "testdb", User: "nonexistent"}
+			connection.Driver = testhelper.TestDriver{ErrToReturn: pgx.PgError{Severity: "FATAL", Code: "28000", Message: `role "nonexistent" does not exist`}, DB: mockdb, DBName: "testdb", User: "nonexistent"}
 			Expect(connection.User).To(Equal("nonexistent"))
 			expectedStr := fmt.Sprintf("Role \"nonexistent\" does not exist on %s:%d, exiting", connection.Host, connection.Port)
 			defer testhelper.ShouldPanicWithMessage(expectedStr)
 			connection.MustConnect(1)
 		})
 	})
+	Describe("DBConn.ConnectContext", func() {
+		BeforeEach(func() {
+			connection, mock = testhelper.CreateMockDBConn()
+		})
+		It("makes connections successfully with a context", func() {
+			testhelper.ExpectVersionQuery(mock, "5.1.0")
+			err := connection.ConnectContext(context.Background(), 2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(connection.NumConns).To(Equal(2))
+			Expect(connection.Version.VersionString).To(Equal("5.1.0"))
+		})
+		It("does not connect if the context is already done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := connection.ConnectContext(ctx, 1)
+			Expect(err).To(MatchError("context canceled (testhost:5432)"))
+		})
+		It("stops waiting for a connection attempt when the context deadline passes", func() {
+			mockdb, _ := testhelper.CreateMockDB()
+			unblock := make(chan struct{})
+			defer close(unblock)
+			connection.Driver = blockingDriver{TestDriver: testhelper.TestDriver{DB: mockdb}, unblock: unblock}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			err := connection.ConnectContext(ctx, 1)
+			Expect(err).To(MatchError("context deadline exceeded (testhost:5432)"))
+		})
+	})
 	Describe("DBConn.Close", func() {
 		BeforeEach(func() {
 			connection, mock = testhelper.CreateMockDBConn()
@@ -336,6 +410,193 @@ var _ = Describe("dbconn/dbconn tests", func() {
 			Expect(testSlice[1].Tablename).To(Equal("table2"))
 		})
 	})
+	Describe("DBConn.GetContext", func() {
+		It("executes a GET with a context", func() {
+			one_col_row := sqlmock.NewRows([]string{"tablename"}).AddRow("table1")
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(one_col_row)
+
+			var tablename string
+			err := connection.GetContext(context.Background(), &tablename, "SELECT tablename FROM pg_tables LIMIT 1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tablename).To(Equal("table1"))
+		})
+		It("returns an error if the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			var tablename string
+			err := connection.GetContext(ctx, &tablename, "SELECT tablename FROM pg_tables LIMIT 1")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("DBConn.SelectContext", func() {
+		It("executes a SELECT with a context", func() {
+			one_col_rows := sqlmock.NewRows([]string{"tablename"}).AddRow("table1").AddRow("table2")
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(one_col_rows)
+
+			tablenames := make([]string, 0)
+			err := connection.SelectContext(context.Background(), &tablenames, "SELECT tablename FROM pg_tables")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tablenames).To(Equal([]string{"table1", "table2"}))
+		})
+		It("returns an error if the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			tablenames := make([]string, 0)
+			err := connection.SelectContext(ctx, &tablenames, "SELECT tablename FROM pg_tables")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("DBConn.QueryContext", func() {
+		It("executes a query with a context", func() {
+			one_col_rows := sqlmock.NewRows([]string{"tablename"}).AddRow("table1")
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(one_col_rows)
+
+			rows, err := connection.QueryContext(context.Background(), "SELECT tablename FROM pg_tables")
+			Expect(err).ToNot(HaveOccurred())
+			rows.Close()
+		})
+		It("returns an error if the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := connection.QueryContext(ctx, "SELECT tablename FROM pg_tables")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("DBConn.ExecWithArgsOnConn", func() {
+		BeforeEach(func() {
+			connection, mock = testhelper.CreateAndConnectMockDB(2)
+		})
+		It("executes an INSERT with arguments on the given connection", func() {
+			fakeResult := testhelper.TestResult{Rows: 1}
+			mock.ExpectExec("INSERT (.*)").WithArgs("schema", "table").WillReturnResult(fakeResult)
+
+			res, err := connection.ExecWithArgsOnConn(1, "INSERT INTO pg_tables VALUES ($1, $2)", "schema", "table")
+			Expect(err).ToNot(HaveOccurred())
+			rowsReturned, err := res.RowsAffected()
+			Expect(rowsReturned).To(Equal(int64(1)))
+		})
+		It("executes an INSERT with arguments in a transaction on the given connection", func() {
+			fakeResult := testhelper.TestResult{Rows: 1}
+			ExpectBegin(mock)
+			mock.ExpectExec("INSERT (.*)").WithArgs("schema", "table").WillReturnResult(fakeResult)
+			mock.ExpectCommit()
+
+			connection.MustBegin(1)
+			_, err := connection.ExecWithArgsOnConn(1, "INSERT INTO pg_tables VALUES ($1, $2)", "schema", "table")
+			Expect(connection.Tx[0]).To(BeNil())
+			Expect(connection.Tx[1]).ToNot(BeNil())
+			connection.MustCommit(1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("executes an INSERT with arguments and a context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			fakeResult := testhelper.TestResult{Rows: 1}
+			mock.ExpectExec("INSERT (.*)").WithArgs("schema", "table").WillReturnResult(fakeResult)
+
+			_, err := connection.ExecContextWithArgsOnConn(ctx, 1, "INSERT INTO pg_tables VALUES ($1, $2)", "schema", "table")
+			Expect(err).ToNot(HaveOccurred())
+		})
+		It("panics if given an invalid connection number", func() {
+			defer testhelper.ShouldPanicWithMessage("Invalid connection number: 2")
+			_, _ = connection.ExecWithArgsOnConn(2, "INSERT INTO pg_tables VALUES ($1, $2)", "schema", "table")
+		})
+	})
+	Describe("DBConn.GetWithArgsOnConn", func() {
+		BeforeEach(func() {
+			connection, mock = testhelper.CreateAndConnectMockDB(2)
+		})
+		It("executes a GET with arguments on the given connection", func() {
+			two_col_single_row := sqlmock.NewRows([]string{"schemaname", "tablename"}).
+				AddRow("schema1", "table1")
+			mock.ExpectQuery("SELECT (.*)").WithArgs("table1").WillReturnRows(two_col_single_row)
+
+			testRecord := struct {
+				Schemaname string
+				Tablename  string
+			}{}
+
+			err := connection.GetWithArgsOnConn(1, &testRecord, "SELECT schemaname, tablename FROM two_columns WHERE tablename=$1", "table1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(testRecord.Schemaname).To(Equal("schema1"))
+			Expect(testRecord.Tablename).To(Equal("table1"))
+		})
+		It("executes a GET with arguments and a context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			one_col_row := sqlmock.NewRows([]string{"tablename"}).AddRow("table1")
+			mock.ExpectQuery("SELECT (.*)").WithArgs("table1").WillReturnRows(one_col_row)
+
+			var tablename string
+			err := connection.GetContextWithArgsOnConn(ctx, 1, &tablename, "SELECT tablename FROM pg_tables WHERE tablename=$1", "table1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tablename).To(Equal("table1"))
+		})
+	})
+	Describe("DBConn.SelectWithArgsOnConn", func() {
+		BeforeEach(func() {
+			connection, mock = testhelper.CreateAndConnectMockDB(2)
+		})
+		It("executes a SELECT with arguments in a transaction on the given connection", func() {
+			one_col_rows := sqlmock.NewRows([]string{"tablename"}).AddRow("table1").AddRow("table2")
+			ExpectBegin(mock)
+			mock.ExpectQuery("SELECT (.*)").WithArgs("schema1").WillReturnRows(one_col_rows)
+			mock.ExpectCommit()
+
+			tablenames := make([]string, 0)
+			connection.MustBegin(1)
+			err := connection.SelectWithArgsOnConn(1, &tablenames, "SELECT tablename FROM pg_tables WHERE schemaname=$1", "schema1")
+			connection.MustCommit(1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tablenames).To(Equal([]string{"table1", "table2"}))
+		})
+		It("executes a SELECT with arguments and a context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			one_col_rows := sqlmock.NewRows([]string{"tablename"}).AddRow("table1").AddRow("table2")
+			mock.ExpectQuery("SELECT (.*)").WithArgs("schema1").WillReturnRows(one_col_rows)
+
+			tablenames := make([]string, 0)
+			err := connection.SelectContextWithArgsOnConn(ctx, 1, &tablenames, "SELECT tablename FROM pg_tables WHERE schemaname=$1", "schema1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tablenames).To(Equal([]string{"table1", "table2"}))
+		})
+	})
+	Describe("DBConn.QueryWithArgsOnConn", func() {
+		BeforeEach(func() {
+			connection, mock = testhelper.CreateAndConnectMockDB(2)
+		})
+		It("executes a query with arguments on the given connection", func() {
+			one_col_rows := sqlmock.NewRows([]string{"tablename"}).AddRow("table1")
+			mock.ExpectQuery("SELECT (.*)").WithArgs("schema1").WillReturnRows(one_col_rows)
+
+			rows, err := connection.QueryWithArgsOnConn(1, "SELECT tablename FROM pg_tables WHERE schemaname=$1", "schema1")
+			Expect(err).ToNot(HaveOccurred())
+			defer rows.Close()
+			var tablename string
+			Expect(rows.Next()).To(BeTrue())
+			Expect(rows.Scan(&tablename)).To(Succeed())
+			Expect(tablename).To(Equal("table1"))
+		})
+		It("executes a query with arguments and a context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			one_col_rows := sqlmock.NewRows([]string{"tablename"}).AddRow("table1")
+			mock.ExpectQuery("SELECT (.*)").WithArgs("schema1").WillReturnRows(one_col_rows)
+
+			rows, err := connection.QueryContextWithArgsOnConn(ctx, 1, "SELECT tablename FROM pg_tables WHERE schemaname=$1", "schema1")
+			Expect(err).ToNot(HaveOccurred())
+			rows.Close()
+		})
+	})
 	Describe("DBConn.MustBegin", func() {
 		It("successfully executes a BEGIN outside a transaction", func() {
 			ExpectBegin(mock)
@@ -349,6 +610,21 @@ var _ = Describe("dbconn/dbconn tests", func() {
 			connection.MustBegin()
 		})
 	})
+	Describe("DBConn.BeginContext", func() {
+		It("begins a transaction with a context", func() {
+			ExpectBegin(mock)
+			err := connection.BeginContext(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(connection.Tx[0]).ToNot(BeNil())
+		})
+		It("does not begin a transaction if the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := connection.BeginContext(ctx)
+			Expect(err).To(HaveOccurred())
+			Expect(connection.Tx[0]).To(BeNil())
+		})
+	})
 	Describe("DBConn.MustCommit", func() {
 		It("successfully executes a COMMIT in a transaction", func() {
 			ExpectBegin(mock)
@@ -456,4 +732,21 @@ var _ = Describe("dbconn/dbconn tests", func() {
 			dbconn.MustSelectString(connection, "SELECT foo FROM bar")
 		})
 	})
+	Describe("SelectStringSliceContext", func() {
+		It("returns a slice of strings with a context", func() {
+			one_col_rows := sqlmock.NewRows([]string{"tablename"}).AddRow("table1").AddRow("table2")
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(one_col_rows)
+
+			results, err := dbconn.SelectStringSliceContext(context.Background(), connection, "SELECT tablename FROM pg_tables")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results).To(Equal([]string{"table1", "table2"}))
+		})
+		It("returns an error if the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := dbconn.SelectStringSliceContext(ctx, connection, "SELECT tablename FROM pg_tables")
+			Expect(err).To(HaveOccurred())
+		})
+	})
 })
@@ -0,0 +1,223 @@
+package dbconn
+
+/*
+ * This file contains structs and functions related to inspecting errors
+ * returned by the database or encountered while connecting to it.
+ */
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+/*
+ * Errors reported by the server are returned from DBConn functions as a
+ * PgError holding the fields of the server's error message, along with the
+ * host and port of the server that reported it.  Connection errors are also
+ * returned as a PgError, which has an empty Code if the error did not come
+ * from the server, such as when the connection was refused.
+ *
+ * Err is the error returned by the driver.  The message of a PgError is the
+ * same as that of Err for query errors, while connection errors have a more
+ * descriptive message that includes the host and port.
+ */
+type PgError struct {
+	Code     string // the SQLSTATE code
+	Severity string
+	Message  string
+	Detail   string
+	Hint     string
+	Position int32
+	Host     string
+	Port     int
+	Err      error
+
+	description string
+}
+
+func (pgErr *PgError) Error() string {
+	if pgErr.description != "" {
+		return pgErr.description
+	}
+	return pgErr.Err.Error()
+}
+
+func (pgErr *PgError) Unwrap() error {
+	return pgErr.Err
+}
+
+func newPgError(err error, host string, port int) *PgError {
+	pgErr := &PgError{Host: host, Port: port, Err: err}
+	if serverErr, ok := errors.Cause(err).(pgx.PgError); ok {
+		pgErr.Code = serverErr.Code
+		pgErr.Severity = serverErr.Severity
+		pgErr.Message = serverErr.Message
+		pgErr.Detail = serverErr.Detail
+		pgErr.Hint = serverErr.Hint
+		pgErr.Position = serverErr.Position
+	}
+	return pgErr
+}
+
+/*
+ * Errors from the server are converted to a PgError, and other errors, such
+ * as those returned by a test driver, are returned unchanged.
+ */
+func (dbconn *DBConn) wrapQueryError(err error) error {
+	if _, ok := err.(pgx.PgError); ok {
+		return newPgError(err, dbconn.Host, dbconn.Port)
+	}
+	return err
+}
+
+func (dbconn *DBConn) handleConnectionError(err error) error {
+	if err == nil {
+		return nil
+	}
+	pgErr := newPgError(err, dbconn.Host, dbconn.Port)
+	switch {
+	case pgErr.Code == "3D000":
+		pgErr.description = fmt.Sprintf(`Database "%s" does not exist on %s:%d, exiting`, dbconn.DBName, dbconn.Host, dbconn.Port)
+	case pgErr.Code == "28000" && pgErr.Message == fmt.Sprintf(`role "%s" does not exist`, dbconn.User):
+		pgErr.description = fmt.Sprintf(`Role "%s" does not exist on %s:%d, exiting`, dbconn.User, dbconn.Host, dbconn.Port)
+	case isConnectionRefused(err):
+		pgErr.description = fmt.Sprintf(`could not connect to server: Connection refused
+	Is the server running on host "%s" and accepting
+	TCP/IP connections on port %d?`, dbconn.Host, dbconn.Port)
+	default:
+		pgErr.description = fmt.Sprintf("%v (%s:%d)", err, dbconn.Host, dbconn.Port)
+	}
+	return pgErr
+}
+
+/*
+ * Returns the PgError in the chain of errors wrapped by err, or nil if there is
+ * none.  An error from the server that was not returned by a DBConn function,
+ * such as one from iterating over rows, is converted to a PgError without a
+ * host and port.
+ */
+func GetPgError(err error) *PgError {
+	for err != nil {
+		switch typedErr := err.(type) {
+		case *PgError:
+			return typedErr
+		case pgx.PgError:
+			return newPgError(typedErr, "", 0)
+		}
+		err = unwrapError(err)
+	}
+	return nil
+}
+
+/*
+ * Handles errors wrapped by both github.com/pkg/errors and the standard library.
+ */
+func unwrapError(err error) error {
+	switch wrapper := err.(type) {
+	case interface{ Cause() error }:
+		return wrapper.Cause()
+	case interface{ Unwrap() error }:
+		return wrapper.Unwrap()
+	}
+	return nil
+}
+
+func hasCode(err error, codes ...string) bool {
+	pgErr := GetPgError(err)
+	if pgErr == nil {
+		return false
+	}
+	for _, code := range codes {
+		if pgErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Returns true if the error reports that a database, schema, table, column,
+ * function, or other object referred to does not exist.
+ */
+func IsUndefinedObject(err error) bool {
+	return hasCode(err, "42704", "42P01", "42703", "42883", "3F000", "3D000")
+}
+
+func IsSerializationFailure(err error) bool {
+	return hasCode(err, "40001")
+}
+
+/*
+ * Returns true if the error reports that the user could not be authenticated
+ * or is not allowed to connect, including when the role does not exist.
+ */
+func IsAuthFailure(err error) bool {
+	return hasCode(err, "28000", "28P01")
+}
+
+/*
+ * Returns true if the connection could not be made or was lost, whether the
+ * server reported it, as when the server is shutting down, or the client
+ * detected it.
+ */
+func IsConnectionFailure(err error) bool {
+	if pgErr := GetPgError(err); pgErr != nil && pgErr.Code != "" {
+		return pgErr.Code[:2] == "08" || pgErr.Code == "57P01" || pgErr.Code == "57P02" || pgErr.Code == "57P03"
+	}
+	for ; err != nil; err = unwrapError(err) {
+		if err == driver.ErrBadConn || err == pgx.ErrDeadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+			return true
+		}
+		if _, ok := err.(net.Error); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Returned when a connection is lost while a transaction is in progress on it.
+ * The connection may have been reestablished, but the transaction was rolled
+ * back, so everything done in it must be done again in a new transaction.
+ */
+type TransactionLostError struct {
+	ConnNum int
+	Err     error
+}
+
+func (lostErr *TransactionLostError) Error() string {
+	message := fmt.Sprintf("Connection %d was lost during a transaction, so the transaction was rolled back", lostErr.ConnNum)
+	if lostErr.Err != nil {
+		message += fmt.Sprintf(": %v", lostErr.Err)
+	}
+	return message
+}
+
+func (lostErr *TransactionLostError) Unwrap() error {
+	return lostErr.Err
+}
+
+func IsTransactionLost(err error) bool {
+	for ; err != nil; err = unwrapError(err) {
+		if _, ok := err.(*TransactionLostError); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isConnectionRefused(err error) bool {
+	for ; err != nil; err = unwrapError(err) {
+		if sysErr, ok := err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.ECONNREFUSED
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package dbconn_test
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dbconn/errors tests", func() {
+	undefinedTable := pgx.PgError{
+		Severity: "ERROR",
+		Code:     "42P01",
+		Message:  `relation "foo" does not exist`,
+		Detail:   "some detail",
+		Hint:     "some hint",
+		Position: 15,
+	}
+
+	Describe("query errors", func() {
+		It("returns an error from the server as a PgError with the host and port", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnError(undefinedTable)
+
+			var count int
+			err := connection.Get(&count, "SELECT count(*) FROM foo")
+			Expect(err).To(MatchError(`ERROR: relation "foo" does not exist (SQLSTATE 42P01)`))
+			pgErr, ok := err.(*dbconn.PgError)
+			Expect(ok).To(BeTrue())
+			Expect(*pgErr).To(Equal(dbconn.PgError{
+				Code:     "42P01",
+				Severity: "ERROR",
+				Message:  `relation "foo" does not exist`,
+				Detail:   "some detail",
+				Hint:     "some hint",
+				Position: 15,
+				Host:     "testhost",
+				Port:     5432,
+				Err:      undefinedTable,
+			}))
+		})
+		It("returns other errors unchanged", func() {
+			driverErr := fmt.Errorf("some driver error")
+			mock.ExpectExec("INSERT (.*)").WillReturnError(driverErr)
+
+			_, err := connection.Exec("INSERT INTO foo VALUES (1)")
+			Expect(err).To(Equal(driverErr))
+		})
+	})
+	Describe("connection errors", func() {
+		BeforeEach(func() {
+			connection, mock = testhelper.CreateMockDBConn()
+		})
+		It("returns a refused connection as a PgError without a code", func() {
+			connectionRefused := &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}
+			connection.Driver = testhelper.TestDriver{ErrToReturn: connectionRefused}
+
+			err := connection.Connect(1)
+			pgErr := dbconn.GetPgError(err)
+			Expect(pgErr).ToNot(BeNil())
+			Expect(pgErr.Code).To(Equal(""))
+			Expect(pgErr.Host).To(Equal("testhost"))
+			Expect(pgErr.Err).To(Equal(connectionRefused))
+			Expect(dbconn.IsConnectionFailure(err)).To(BeTrue())
+		})
+		It("reports a missing database", func() {
+			connection.Driver = testhelper.TestDriver{ErrToReturn: pgx.PgError{Severity: "FATAL", Code: "3D000", Message: `database "testdb" does not exist`}}
+
+			err := connection.Connect(1)
+			Expect(err).To(MatchError(`Database "testdb" does not exist on testhost:5432, exiting`))
+			Expect(dbconn.GetPgError(err).Code).To(Equal("3D000"))
+			Expect(dbconn.IsUndefinedObject(err)).To(BeTrue())
+		})
+		It("reports other authorization failures with the server's message", func() {
+			connection.Driver = testhelper.TestDriver{ErrToReturn: pgx.PgError{Severity: "FATAL", Code: "28000", Message: `no pg_hba.conf entry for host "10.0.0.1"`}}
+
+			err := connection.Connect(1)
+			Expect(err).To(MatchError(`FATAL: no pg_hba.conf entry for host "10.0.0.1" (SQLSTATE 28000) (testhost:5432)`))
+			Expect(dbconn.IsAuthFailure(err)).To(BeTrue())
+		})
+	})
+	Describe("GetPgError", func() {
+		It("finds a PgError wrapped by other errors", func() {
+			pgErr := &dbconn.PgError{Code: "42P01", Err: undefinedTable}
+			Expect(dbconn.GetPgError(errors.Wrap(pgErr, "Unable to read table"))).To(Equal(pgErr))
+		})
+		It("converts an error from the server", func() {
+			pgErr := dbconn.GetPgError(errors.Wrap(undefinedTable, "Unable to read table"))
+			Expect(pgErr).ToNot(BeNil())
+			Expect(pgErr.Code).To(Equal("42P01"))
+			Expect(pgErr.Hint).To(Equal("some hint"))
+		})
+		It("returns nil if there is no error from the server", func() {
+			Expect(dbconn.GetPgError(fmt.Errorf("some error"))).To(BeNil())
+			Expect(dbconn.GetPgError(nil)).To(BeNil())
+		})
+	})
+	Describe("error predicates", func() {
+		withCode := func(code string) error {
+			return errors.Wrap(pgx.PgError{Code: code}, "wrapped")
+		}
+		It("detects undefined objects", func() {
+			Expect(dbconn.IsUndefinedObject(withCode("42P01"))).To(BeTrue())
+			Expect(dbconn.IsUndefinedObject(withCode("42883"))).To(BeTrue())
+			Expect(dbconn.IsUndefinedObject(withCode("23505"))).To(BeFalse())
+		})
+		It("detects serialization failures", func() {
+			Expect(dbconn.IsSerializationFailure(withCode("40001"))).To(BeTrue())
+			Expect(dbconn.IsSerializationFailure(withCode("40P01"))).To(BeFalse())
+		})
+		It("detects authentication failures", func() {
+			Expect(dbconn.IsAuthFailure(withCode("28P01"))).To(BeTrue())
+			Expect(dbconn.IsAuthFailure(withCode("42501"))).To(BeFalse())
+		})
+		It("detects connection failures reported by the server or the client", func() {
+			Expect(dbconn.IsConnectionFailure(withCode("08006"))).To(BeTrue())
+			Expect(dbconn.IsConnectionFailure(withCode("57P01"))).To(BeTrue())
+			Expect(dbconn.IsConnectionFailure(errors.Wrap(driver.ErrBadConn, "wrapped"))).To(BeTrue())
+			Expect(dbconn.IsConnectionFailure(pgx.ErrDeadConn)).To(BeTrue())
+			Expect(dbconn.IsConnectionFailure(withCode("42P01"))).To(BeFalse())
+			Expect(dbconn.IsConnectionFailure(fmt.Errorf("some error"))).To(BeFalse())
+			Expect(dbconn.IsConnectionFailure(nil)).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package dbconn
+
+/*
+ * Backend process IDs and pgx connections are only recorded by the pgx driver,
+ * so tests using a test driver set them directly.
+ */
+func SetBackendPID(dbconn *DBConn, connNum int, pid int) {
+	dbconn.setBackend(connNum, pid, nil)
+}
+
+func SetCopyConn(dbconn *DBConn, connNum int, pid int, conn copyConn) {
+	dbconn.setBackend(connNum, pid, conn)
+}
@@ -0,0 +1,147 @@
+package dbconn
+
+/*
+ * This file contains structs and functions related to checking that the
+ * connections in a DBConn are usable and reestablishing them if they are not.
+ */
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+/*
+ * By default, a connection that is lost, such as when its backend process is
+ * terminated or its segment fails over, stays unusable until the DBConn is
+ * closed and connected again.  If MaxAttempts is positive, a connection that
+ * fails with a connection error (see IsConnectionFailure) is instead
+ * reestablished automatically, making up to MaxAttempts attempts to connect
+ * with Delay between them.
+ *
+ * Runtime parameters, including those changed with SetRuntimeParam, are set
+ * on a reestablished connection just as on the original connection.
+ *
+ * The statement that failed is not retried, as it may have succeeded before
+ * the connection was lost, but the connection can be used again as soon as the
+ * error is returned.  If a transaction was in progress on the connection, the
+ * error is a TransactionLostError, as the transaction was rolled back by the
+ * server and must be started over.
+ */
+type ReconnectPolicy struct {
+	MaxAttempts int
+	Delay       time.Duration
+}
+
+/*
+ * Checks that the given connection is usable by running a trivial query on it,
+ * waiting at most the given timeout if it is positive.  A connection with a
+ * failed transaction in progress is reported as unusable until the transaction
+ * is rolled back.
+ */
+func (dbconn *DBConn) Ping(connNum int, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	_, err := dbconn.ExecContextWithArgsOnConn(ctx, connNum, "SELECT 1")
+	return err
+}
+
+/*
+ * Pings all connections concurrently, returning the errors for those that
+ * are not usable keyed by connection number; the map is empty if all of the
+ * connections are usable.
+ */
+func (dbconn *DBConn) PingAll(timeout time.Duration) map[int]error {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	pingErrors := make(map[int]error, 0)
+	for connNum := 0; connNum < dbconn.NumConns; connNum++ {
+		wg.Add(1)
+		go func(connNum int) {
+			defer wg.Done()
+			if err := dbconn.Ping(connNum, timeout); err != nil {
+				mutex.Lock()
+				pingErrors[connNum] = err
+				mutex.Unlock()
+			}
+		}(connNum)
+	}
+	wg.Wait()
+	return pingErrors
+}
+
+/*
+ * Closes the given connection and connects it again, using the reconnection
+ * policy if one is set, or making a single attempt if not.  Any transaction in
+ * progress is rolled back, in which case a TransactionLostError is returned if
+ * reconnecting succeeds.
+ */
+func (dbconn *DBConn) Reconnect(connNum int) error {
+	connNum = dbconn.ValidateConnNum(connNum)
+	lostTransaction := dbconn.Tx[connNum] != nil
+	if lostTransaction {
+		_ = dbconn.Tx[connNum].Rollback()
+		dbconn.setTx(connNum, nil)
+	}
+	backendPID := dbconn.backendPID(connNum)
+	_ = dbconn.ConnPool[connNum].Close()
+	dbconn.setBackend(connNum, 0, nil)
+	dbconn.connectionClosed(connNum, backendPID)
+
+	maxAttempts := dbconn.ReconnectPolicy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	var conn *sqlx.DB
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(dbconn.ReconnectPolicy.Delay)
+		}
+		conn, err = dbconn.connectDriver(context.Background(), dbconn.connStr(connNum))
+		err = dbconn.handleConnectionError(err)
+		if err == nil {
+			break
+		}
+		gplog.Verbose("Attempt %d of %d to reconnect connection %d failed: %v", attempt, maxAttempts, connNum, err)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Unable to reconnect connection %d", connNum)
+	}
+	conn.SetMaxOpenConns(1)
+	conn.SetMaxIdleConns(1)
+	dbconn.connectionOpened(connNum, conn)
+	gplog.Verbose("Reconnected connection %d", connNum)
+	if lostTransaction {
+		return &TransactionLostError{ConnNum: connNum}
+	}
+	return nil
+}
+
+/*
+ * Converts errors from the server to a PgError and, if a reconnection policy
+ * is set and the connection was lost, reconnects before returning the error.
+ */
+func (dbconn *DBConn) handleQueryError(connNum int, err error) error {
+	err = dbconn.wrapQueryError(err)
+	if err == nil || dbconn.ReconnectPolicy.MaxAttempts < 1 || !IsConnectionFailure(err) {
+		return err
+	}
+	gplog.Verbose("Connection %d was lost: %v", connNum, err)
+	reconnectErr := dbconn.Reconnect(connNum)
+	if lostErr, ok := reconnectErr.(*TransactionLostError); ok {
+		lostErr.Err = err
+		return lostErr
+	} else if reconnectErr != nil {
+		gplog.Verbose("%v", reconnectErr)
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package dbconn_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+	"github.com/jackc/pgx"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dbconn/health tests", func() {
+	fakeResult := testhelper.TestResult{Rows: 1}
+	adminShutdown := pgx.PgError{Severity: "FATAL", Code: "57P01", Message: "terminating connection due to administrator command"}
+
+	BeforeEach(func() {
+		connection, mock = createAndConnectSeparateMockDB(2)
+	})
+	Describe("DBConn.Ping", func() {
+		It("succeeds if the connection is usable", func() {
+			mock.ExpectExec("SELECT 1").WillReturnResult(fakeResult)
+			Expect(connection.Ping(1, time.Second)).To(Succeed())
+		})
+		It("returns an error if the connection is not usable", func() {
+			mock.ExpectExec("SELECT 1").WillReturnError(adminShutdown)
+			err := connection.Ping(1, time.Second)
+			Expect(dbconn.IsConnectionFailure(err)).To(BeTrue())
+		})
+		It("returns an error if the connection does not respond in time", func() {
+			mock.ExpectExec("SELECT 1").WillDelayFor(time.Second).WillReturnResult(fakeResult)
+			Expect(connection.Ping(1, 10*time.Millisecond)).ToNot(Succeed())
+		})
+	})
+	Describe("DBConn.PingAll", func() {
+		BeforeEach(func() {
+			mock.MatchExpectationsInOrder(false)
+		})
+		It("returns no errors if all connections are usable", func() {
+			mock.ExpectExec("SELECT 1").WillReturnResult(fakeResult)
+			mock.ExpectExec("SELECT 1").WillReturnResult(fakeResult)
+			Expect(connection.PingAll(time.Second)).To(BeEmpty())
+		})
+		It("returns the errors for connections that are not usable", func() {
+			mock.ExpectExec("SELECT 1").WillReturnResult(fakeResult)
+			mock.ExpectExec("SELECT 1").WillReturnError(adminShutdown)
+			pingErrors := connection.PingAll(time.Second)
+			Expect(pingErrors).To(HaveLen(1))
+			for _, err := range pingErrors {
+				Expect(dbconn.IsConnectionFailure(err)).To(BeTrue())
+			}
+		})
+	})
+	Describe("DBConn.Reconnect", func() {
+		It("replaces the connection", func() {
+			oldConn := connection.ConnPool[1]
+			Expect(connection.Reconnect(1)).To(Succeed())
+			Expect(connection.ConnPool[1]).ToNot(BeIdenticalTo(oldConn))
+			Expect(connection.ConnPool[0]).ToNot(BeNil())
+		})
+		It("reports a lost transaction", func() {
+			ExpectBegin(mock)
+			mock.ExpectRollback()
+			connection.MustBegin(1)
+
+			err := connection.Reconnect(1)
+			Expect(err).To(MatchError("Connection 1 was lost during a transaction, so the transaction was rolled back"))
+			Expect(dbconn.IsTransactionLost(err)).To(BeTrue())
+			Expect(connection.Tx[1]).To(BeNil())
+		})
+		It("makes the number of attempts given by the reconnection policy", func() {
+			connStrs := make([]string, 0)
+			connection.Driver = recordingDriver{TestDriver: testhelper.TestDriver{ErrToReturn: fmt.Errorf("the database system is starting up")}, connStrs: &connStrs}
+			connection.ReconnectPolicy = dbconn.ReconnectPolicy{MaxAttempts: 3}
+
+			err := connection.Reconnect(1)
+			Expect(err).To(MatchError("Unable to reconnect connection 1: the database system is starting up (testhost:5432)"))
+			Expect(connStrs).To(HaveLen(3))
+		})
+	})
+	Describe("automatic reconnection", func() {
+		It("does not reconnect without a reconnection policy", func() {
+			oldConn := connection.ConnPool[0]
+			mock.ExpectExec("INSERT (.*)").WillReturnError(adminShutdown)
+
+			_, err := connection.Exec("INSERT INTO foo VALUES (1)")
+			Expect(dbconn.IsConnectionFailure(err)).To(BeTrue())
+			Expect(connection.ConnPool[0]).To(BeIdenticalTo(oldConn))
+		})
+		It("reconnects a lost connection and returns the original error", func() {
+			connection.ReconnectPolicy = dbconn.ReconnectPolicy{MaxAttempts: 1}
+			oldConn := connection.ConnPool[0]
+			mock.ExpectExec("INSERT (.*)").WillReturnError(adminShutdown)
+			mock.ExpectExec("INSERT (.*)").WillReturnResult(fakeResult)
+
+			_, err := connection.Exec("INSERT INTO foo VALUES (1)")
+			Expect(err).To(MatchError("FATAL: terminating connection due to administrator command (SQLSTATE 57P01)"))
+			Expect(connection.ConnPool[0]).ToNot(BeIdenticalTo(oldConn))
+			_, err = connection.Exec("INSERT INTO foo VALUES (1)")
+			Expect(err).ToNot(HaveOccurred())
+		})
+		It("reports a transaction lost along with the connection", func() {
+			connection.ReconnectPolicy = dbconn.ReconnectPolicy{MaxAttempts: 1}
+			ExpectBegin(mock)
+			mock.ExpectExec("INSERT (.*)").WillReturnError(adminShutdown)
+			mock.ExpectRollback()
+			connection.MustBegin()
+
+			_, err := connection.Exec("INSERT INTO foo VALUES (1)")
+			Expect(err).To(MatchError("Connection 0 was lost during a transaction, so the transaction was rolled back: FATAL: terminating connection due to administrator command (SQLSTATE 57P01)"))
+			Expect(dbconn.IsTransactionLost(err)).To(BeTrue())
+			Expect(dbconn.IsConnectionFailure(err)).To(BeTrue())
+			Expect(connection.Tx[0]).To(BeNil())
+		})
+		It("does not reconnect after other errors", func() {
+			connection.ReconnectPolicy = dbconn.ReconnectPolicy{MaxAttempts: 1}
+			oldConn := connection.ConnPool[0]
+			mock.ExpectExec("INSERT (.*)").WillReturnError(pgx.PgError{Severity: "ERROR", Code: "23505", Message: "duplicate key"})
+
+			_, err := connection.Exec("INSERT INTO foo VALUES (1)")
+			Expect(err).To(HaveOccurred())
+			Expect(connection.ConnPool[0]).To(BeIdenticalTo(oldConn))
+		})
+	})
+})
@@ -0,0 +1,172 @@
+package dbconn
+
+/*
+ * This file contains structs and functions related to running jobs in
+ * parallel on the connections in a DBConn.
+ */
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ * A Job is given a connection number that no other job is using at the same
+ * time, and should use only that connection.  It should stop early and return
+ * an error if the context is done, which is easiest to ensure by passing the
+ * context to the "Context" functions of the DBConn.
+ */
+type Job func(ctx context.Context, connNum int) error
+
+/*
+ * MaxConcurrency limits the number of jobs run at once; it defaults to, and
+ * cannot exceed, the number of connections.
+ *
+ * By default, once a job fails, no more jobs are started and the context passed
+ * to running jobs is cancelled, and RunJobs returns the error from that job.
+ * If CollectAllErrors is set, all jobs are run regardless of errors, and RunJobs
+ * returns a JobErrors holding the error from each job that failed.
+ *
+ * If set, OnJobDone is called after each job finishes with the index of the job
+ * in the list passed to RunJobs, the number of jobs finished so far (including
+ * this one), the total number of jobs, and the error from the job, if any.  It
+ * is always called from the goroutine that called RunJobs, so it does not need
+ * to be safe to call concurrently, though it delays the starting of more jobs
+ * until it returns.
+ */
+type JobOptions struct {
+	MaxConcurrency   int
+	CollectAllErrors bool
+	OnJobDone        func(jobNum int, numFinished int, numJobs int, err error)
+}
+
+/*
+ * Holds the error from each failed job, keyed by the index of the job in the
+ * list passed to RunJobs.
+ */
+type JobErrors map[int]error
+
+func (jobErrors JobErrors) Error() string {
+	jobNums := make([]int, 0, len(jobErrors))
+	for jobNum := range jobErrors {
+		jobNums = append(jobNums, jobNum)
+	}
+	sort.Ints(jobNums)
+	messages := make([]string, len(jobNums))
+	for i, jobNum := range jobNums {
+		messages[i] = fmt.Sprintf("job %d: %v", jobNum, jobErrors[jobNum])
+	}
+	return fmt.Sprintf("%d job(s) failed: %s", len(jobErrors), strings.Join(messages, "; "))
+}
+
+type jobResult struct {
+	jobNum   int
+	err      error
+	panicked bool
+	panicVal interface{}
+}
+
+/*
+ * Runs the given jobs in parallel, each with a dedicated connection, until all
+ * jobs have finished or the context is done, in which case jobs that have not
+ * started are skipped and the error from the context is returned if no job
+ * failed.
+ *
+ * If a job panics, no more jobs are started, and the panic continues in the
+ * goroutine that called RunJobs once the running jobs have finished, so that
+ * it can be recovered there as if the job had run in that goroutine.
+ */
+func (dbconn *DBConn) RunJobs(ctx context.Context, jobs []Job, options JobOptions) error {
+	numWorkers := dbconn.NumConns
+	if options.MaxConcurrency > 0 && options.MaxConcurrency < numWorkers {
+		numWorkers = options.MaxConcurrency
+	}
+	if numWorkers < 1 {
+		return errors.New("Cannot run jobs; the database connection is not connected")
+	}
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobNums := make(chan int)
+	go func() {
+		defer close(jobNums)
+		for jobNum := range jobs {
+			select {
+			case jobNums <- jobNum:
+			case <-jobCtx.Done():
+				return
+			}
+		}
+	}()
+
+	results := make(chan jobResult)
+	var wg sync.WaitGroup
+	for connNum := 0; connNum < numWorkers; connNum++ {
+		wg.Add(1)
+		go func(connNum int) {
+			defer wg.Done()
+			for jobNum := range jobNums {
+				if jobCtx.Err() != nil {
+					continue
+				}
+				results <- runJob(jobCtx, jobs[jobNum], jobNum, connNum)
+			}
+		}(connNum)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	jobErrors := make(JobErrors, 0)
+	var firstErr error
+	var panicResult *jobResult
+	numFinished := 0
+	for result := range results {
+		numFinished++
+		if result.panicked {
+			if panicResult == nil {
+				panicResult = &jobResult{panicked: true, panicVal: result.panicVal}
+			}
+			cancel()
+			continue
+		}
+		if options.OnJobDone != nil {
+			options.OnJobDone(result.jobNum, numFinished, len(jobs), result.err)
+		}
+		if result.err != nil {
+			jobErrors[result.jobNum] = result.err
+			if firstErr == nil && !options.CollectAllErrors {
+				firstErr = result.err
+				cancel()
+			}
+		}
+	}
+	if panicResult != nil {
+		panic(panicResult.panicVal)
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if len(jobErrors) > 0 {
+		return jobErrors
+	}
+	return ctx.Err()
+}
+
+func runJob(ctx context.Context, job Job, jobNum int, connNum int) (result jobResult) {
+	result.jobNum = jobNum
+	defer func() {
+		if panicVal := recover(); panicVal != nil {
+			result.panicked = true
+			result.panicVal = panicVal
+		}
+	}()
+	result.err = job(ctx, connNum)
+	return result
+}
@@ -0,0 +1,166 @@
+package dbconn_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dbconn/jobs tests", func() {
+	var usedConns map[int]int
+	var connLock sync.Mutex
+
+	recordingJob := func(ctx context.Context, connNum int) error {
+		connLock.Lock()
+		defer connLock.Unlock()
+		usedConns[connNum]++
+		return nil
+	}
+	failingJob := func(ctx context.Context, connNum int) error {
+		return errors.New("job failed")
+	}
+	waitingJob := func(ctx context.Context, connNum int) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	BeforeEach(func() {
+		connection, mock = createAndConnectSeparateMockDB(3)
+		usedConns = make(map[int]int)
+	})
+	Describe("DBConn.RunJobs", func() {
+		It("runs every job on a connection in the pool", func() {
+			jobs := []dbconn.Job{recordingJob, recordingJob, recordingJob, recordingJob, recordingJob}
+			Expect(connection.RunJobs(context.Background(), jobs, dbconn.JobOptions{})).To(Succeed())
+
+			numJobs := 0
+			for connNum, count := range usedConns {
+				Expect(connNum).To(BeNumerically("<", 3))
+				numJobs += count
+			}
+			Expect(numJobs).To(Equal(5))
+		})
+		It("does not run more jobs at once than MaxConcurrency", func() {
+			running, maxRunning := 0, 0
+			job := func(ctx context.Context, connNum int) error {
+				connLock.Lock()
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				usedConns[connNum]++
+				connLock.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				connLock.Lock()
+				running--
+				connLock.Unlock()
+				return nil
+			}
+			jobs := []dbconn.Job{job, job, job, job}
+			Expect(connection.RunJobs(context.Background(), jobs, dbconn.JobOptions{MaxConcurrency: 1})).To(Succeed())
+
+			Expect(maxRunning).To(Equal(1))
+			Expect(usedConns).To(Equal(map[int]int{0: 4}))
+		})
+		It("never gives the same connection to two jobs at once", func() {
+			inUse := make(map[int]bool)
+			sharedConns := make([]int, 0)
+			job := func(ctx context.Context, connNum int) error {
+				connLock.Lock()
+				if inUse[connNum] {
+					sharedConns = append(sharedConns, connNum)
+				}
+				inUse[connNum] = true
+				connLock.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				connLock.Lock()
+				inUse[connNum] = false
+				connLock.Unlock()
+				return nil
+			}
+			jobs := []dbconn.Job{job, job, job, job, job, job, job}
+			Expect(connection.RunJobs(context.Background(), jobs, dbconn.JobOptions{})).To(Succeed())
+
+			Expect(sharedConns).To(BeEmpty())
+		})
+		It("stops running jobs and returns the first error by default", func() {
+			jobs := []dbconn.Job{failingJob, waitingJob, waitingJob}
+			for i := 0; i < 10; i++ {
+				jobs = append(jobs, recordingJob)
+			}
+			err := connection.RunJobs(context.Background(), jobs, dbconn.JobOptions{MaxConcurrency: 3})
+
+			Expect(err).To(MatchError("job failed"))
+			numJobs := 0
+			for _, count := range usedConns {
+				numJobs += count
+			}
+			Expect(numJobs).To(BeNumerically("<", 10))
+		})
+		It("runs every job and returns every error if CollectAllErrors is set", func() {
+			jobs := []dbconn.Job{failingJob, recordingJob, failingJob, recordingJob}
+			err := connection.RunJobs(context.Background(), jobs, dbconn.JobOptions{CollectAllErrors: true})
+
+			Expect(err).To(MatchError("2 job(s) failed: job 0: job failed; job 2: job failed"))
+			jobErrors, ok := err.(dbconn.JobErrors)
+			Expect(ok).To(BeTrue())
+			Expect(jobErrors).To(HaveLen(2))
+			Expect(jobErrors).To(HaveKey(0))
+			Expect(jobErrors).To(HaveKey(2))
+			Expect(usedConns[0] + usedConns[1] + usedConns[2]).To(Equal(2))
+		})
+		It("stops running jobs if the context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			jobs := []dbconn.Job{waitingJob, waitingJob, waitingJob, recordingJob, recordingJob}
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				cancel()
+			}()
+			err := connection.RunJobs(ctx, jobs, dbconn.JobOptions{})
+
+			Expect(err).To(Equal(context.Canceled))
+			Expect(usedConns).To(BeEmpty())
+		})
+		It("reports the progress of each job", func() {
+			type progress struct {
+				jobNum, numFinished, numJobs int
+				err                          error
+			}
+			reports := make([]progress, 0)
+			options := dbconn.JobOptions{
+				MaxConcurrency:   1,
+				CollectAllErrors: true,
+				OnJobDone: func(jobNum int, numFinished int, numJobs int, err error) {
+					reports = append(reports, progress{jobNum, numFinished, numJobs, err})
+				},
+			}
+			jobs := []dbconn.Job{recordingJob, failingJob, recordingJob}
+			_ = connection.RunJobs(context.Background(), jobs, options)
+
+			Expect(reports).To(HaveLen(3))
+			Expect(reports[0]).To(Equal(progress{0, 1, 3, nil}))
+			Expect(reports[1].jobNum).To(Equal(1))
+			Expect(reports[1].numFinished).To(Equal(2))
+			Expect(reports[1].err).To(MatchError("job failed"))
+			Expect(reports[2]).To(Equal(progress{2, 3, 3, nil}))
+		})
+		It("continues a panic from a job in the calling goroutine", func() {
+			panickingJob := func(ctx context.Context, connNum int) error {
+				panic("job panicked")
+			}
+			jobs := []dbconn.Job{panickingJob, recordingJob}
+			Expect(func() { _ = connection.RunJobs(context.Background(), jobs, dbconn.JobOptions{}) }).To(Panic())
+		})
+		It("returns an error if the connection is not connected", func() {
+			connection.Close()
+			err := connection.RunJobs(context.Background(), []dbconn.Job{recordingJob}, dbconn.JobOptions{})
+			Expect(err).To(MatchError("Cannot run jobs; the database connection is not connected"))
+		})
+	})
+})
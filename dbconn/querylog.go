@@ -0,0 +1,90 @@
+package dbconn
+
+/*
+ * This file contains structs and functions related to logging and timing the
+ * statements run on a DBConn.
+ */
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+)
+
+/*
+ * Describes a statement that has finished running.  RowsAffected is the number
+ * of rows changed by Exec, read by Get or Select, or copied by CopyFrom or
+ * CopyTo; it is -1 for Query, which returns before the rows are read, and when
+ * the statement failed.
+ */
+type QueryInfo struct {
+	ConnNum      int
+	Query        string
+	Duration     time.Duration
+	RowsAffected int64
+	Err          error
+}
+
+/*
+ * A QueryHook is called after every statement run through the DBConn, such as
+ * to record timings in a utility's own metrics.  It may be called from several
+ * goroutines at once if the connections are used in parallel.
+ */
+type QueryHook interface {
+	AfterQuery(info QueryInfo)
+}
+
+/*
+ * Allows using an ordinary function as a QueryHook.
+ */
+type QueryHookFunc func(info QueryInfo)
+
+func (hookFunc QueryHookFunc) AfterQuery(info QueryInfo) {
+	hookFunc(info)
+}
+
+func (dbconn *DBConn) logQuery(connNum int, query string, start time.Time, rowsAffected int64, err error) {
+	info := QueryInfo{
+		ConnNum:      connNum,
+		Query:        query,
+		Duration:     operating.System.Now().Sub(start),
+		RowsAffected: rowsAffected,
+		Err:          err,
+	}
+	if err != nil {
+		info.RowsAffected = -1
+	}
+	isSlow := dbconn.SlowQueryThreshold > 0 && info.Duration >= dbconn.SlowQueryThreshold
+	if isSlow || dbconn.LogQueries {
+		result := ""
+		if err != nil {
+			result = fmt.Sprintf(" and failed with error %v", err)
+		} else if info.RowsAffected >= 0 {
+			result = fmt.Sprintf(" for %d rows", info.RowsAffected)
+		}
+		if isSlow {
+			gplog.Warn("Slow query on connection %d took %v%s: %s", connNum, info.Duration, result, query)
+		} else {
+			gplog.Debug("Query on connection %d took %v%s: %s", connNum, info.Duration, result, query)
+		}
+	}
+	dbconn.recordQuery(info)
+	if dbconn.QueryHook != nil {
+		dbconn.QueryHook.AfterQuery(info)
+	}
+}
+
+/*
+ * Select appends the rows it reads to the slice it is given, so the number of
+ * rows read is the difference in the length of the slice.
+ */
+func sliceLen(destination interface{}) int64 {
+	value := reflect.Indirect(reflect.ValueOf(destination))
+	if value.Kind() != reflect.Slice {
+		return -1
+	}
+	return int64(value.Len())
+}
@@ -0,0 +1,128 @@
+package dbconn_test
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+)
+
+var _ = Describe("dbconn/querylog tests", func() {
+	var logfile *gbytes.Buffer
+	var queries []dbconn.QueryInfo
+	var queryLock sync.Mutex
+
+	BeforeEach(func() {
+		_, _, logfile = testhelper.SetupTestLogger()
+		queries = make([]dbconn.QueryInfo, 0)
+		connection.QueryHook = dbconn.QueryHookFunc(func(info dbconn.QueryInfo) {
+			queryLock.Lock()
+			defer queryLock.Unlock()
+			queries = append(queries, info)
+		})
+
+		// Each call to Now is a second later than the last, so every query takes one second
+		now := time.Date(2017, time.January, 1, 1, 1, 1, 1, time.Local)
+		operating.System.Now = func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		}
+	})
+	AfterEach(func() {
+		operating.System = operating.InitializeSystemFunctions()
+	})
+	Describe("logging", func() {
+		It("does not log statements unless LogQueries is set", func() {
+			mock.ExpectExec("DELETE FROM foo").WillReturnResult(testhelper.TestResult{Rows: 3})
+			connection.MustExec("DELETE FROM foo")
+
+			Expect(string(logfile.Contents())).ToNot(ContainSubstring("DELETE FROM foo"))
+		})
+		It("logs statements at the Debug level with their duration and rows affected", func() {
+			connection.LogQueries = true
+			mock.ExpectExec("DELETE FROM foo").WillReturnResult(testhelper.TestResult{Rows: 3})
+			connection.MustExec("DELETE FROM foo")
+
+			Expect(logfile).To(gbytes.Say(`\[DEBUG\]:-Query on connection 0 took 1s for 3 rows: DELETE FROM foo`))
+		})
+		It("logs failed statements with their error", func() {
+			connection.LogQueries = true
+			mock.ExpectExec("DELETE FROM foo").WillReturnError(errors.New("permission denied"))
+			_, _ = connection.Exec("DELETE FROM foo")
+
+			Expect(logfile).To(gbytes.Say(`\[DEBUG\]:-Query on connection 0 took 1s and failed with error permission denied: DELETE FROM foo`))
+		})
+		It("logs slow statements at the Warn level even if LogQueries is not set", func() {
+			connection.SlowQueryThreshold = time.Second
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows([]string{"foo"}).AddRow("one"))
+			_, _ = dbconn.SelectStringSlice(connection, "SELECT foo FROM bar")
+
+			Expect(logfile).To(gbytes.Say(`\[WARNING\]:-Slow query on connection 0 took 1s: SELECT foo FROM bar`))
+		})
+		It("does not log statements faster than SlowQueryThreshold at the Warn level", func() {
+			connection.LogQueries = true
+			connection.SlowQueryThreshold = time.Minute
+			mock.ExpectExec("DELETE FROM foo").WillReturnResult(testhelper.TestResult{Rows: 3})
+			connection.MustExec("DELETE FROM foo")
+
+			Expect(string(logfile.Contents())).ToNot(ContainSubstring("WARNING"))
+			Expect(logfile).To(gbytes.Say(`\[DEBUG\]:-Query on connection 0 took 1s for 3 rows: DELETE FROM foo`))
+		})
+	})
+	Describe("QueryHook", func() {
+		It("is called after each kind of statement with the rows affected", func() {
+			type result struct {
+				Foo string
+			}
+			mock.ExpectExec("DELETE FROM foo").WillReturnResult(testhelper.TestResult{Rows: 3})
+			mock.ExpectQuery("SELECT foo FROM bar").WillReturnRows(sqlmock.NewRows([]string{"foo"}).AddRow("one"))
+			mock.ExpectQuery("SELECT foo FROM baz").WillReturnRows(sqlmock.NewRows([]string{"foo"}).AddRow("one").AddRow("two"))
+			mock.ExpectQuery("SELECT foo FROM qux").WillReturnRows(sqlmock.NewRows([]string{"foo"}).AddRow("one"))
+
+			connection.MustExec("DELETE FROM foo")
+			var single result
+			Expect(connection.Get(&single, "SELECT foo FROM bar")).To(Succeed())
+			multiple := []result{{"existing"}}
+			Expect(connection.Select(&multiple, "SELECT foo FROM baz")).To(Succeed())
+			rows, err := connection.Query("SELECT foo FROM qux")
+			Expect(err).ToNot(HaveOccurred())
+			rows.Close()
+
+			Expect(queries).To(Equal([]dbconn.QueryInfo{
+				{ConnNum: 0, Query: "DELETE FROM foo", Duration: time.Second, RowsAffected: 3},
+				{ConnNum: 0, Query: "SELECT foo FROM bar", Duration: time.Second, RowsAffected: 1},
+				{ConnNum: 0, Query: "SELECT foo FROM baz", Duration: time.Second, RowsAffected: 2},
+				{ConnNum: 0, Query: "SELECT foo FROM qux", Duration: time.Second, RowsAffected: -1},
+			}))
+		})
+		It("is given the error from a failed statement", func() {
+			mock.ExpectExec("DELETE FROM foo").WillReturnError(errors.New("permission denied"))
+			_, _ = connection.Exec("DELETE FROM foo")
+
+			Expect(queries).To(HaveLen(1))
+			Expect(queries[0].RowsAffected).To(Equal(int64(-1)))
+			Expect(queries[0].Err).To(MatchError("permission denied"))
+		})
+		It("is called after a COPY with the rows copied", func() {
+			connection, mock = createAndConnectSeparateMockDB(1)
+			connection.QueryHook = dbconn.QueryHookFunc(func(info dbconn.QueryInfo) {
+				queries = append(queries, info)
+			})
+			dbconn.SetCopyConn(connection, 0, 1234, &fakeCopyConn{})
+
+			_, err := connection.CopyFrom(0, "public.foo", nil, strings.NewReader("1\n2\n"))
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(queries).To(Equal([]dbconn.QueryInfo{{ConnNum: 0, Query: "COPY public.foo FROM STDIN", Duration: time.Second, RowsAffected: 2}}))
+		})
+	})
+})
@@ -0,0 +1,142 @@
+package dbconn
+
+/*
+ * This file contains functions for evaluating expressions on every segment
+ * through the master, using gp_dist_random.
+ */
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/jmoiron/sqlx/reflectx"
+	"github.com/pkg/errors"
+)
+
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+/*
+ * Returns the expression giving the content ID of the segment a row came from;
+ * GPDB 6 added gp_execution_segment() for this, while earlier versions use the
+ * gp_segment_id system column.
+ */
+func (dbconn *DBConn) segmentIDExpression() string {
+	if dbconn.Version.GPDBAtLeast("6") {
+		return "gp_execution_segment()"
+	}
+	return "gp_segment_id"
+}
+
+/*
+ * Evaluates the given select list once on each primary segment, by selecting it
+ * from gp_dist_random('gp_id'), which has one row on each segment.  The select
+ * list may only use functions and constants, such as
+ * "pg_database_size(current_database())" or "current_setting('work_mem'), now()";
+ * tables cannot be read this way.
+ *
+ * The destination must be a pointer to a map from content ID to a type that
+ * Select could scan a row of the select list into, such as a string for a
+ * single expression or a struct with a field for each expression, and the map
+ * must not be nil.  The content IDs of any segments that returned no rows, as
+ * happens when the select list includes a set-returning function that returns
+ * no rows, are returned in order.
+ */
+func MustSelectFromSegments(connection *DBConn, destination interface{}, selectList string, whichConn ...int) []int {
+	missing, err := SelectFromSegments(connection, destination, selectList, whichConn...)
+	gplog.FatalOnError(err)
+	return missing
+}
+
+func SelectFromSegments(connection *DBConn, destination interface{}, selectList string, whichConn ...int) ([]int, error) {
+	return SelectFromSegmentsContext(context.Background(), connection, destination, selectList, whichConn...)
+}
+
+func MustSelectFromSegmentsContext(ctx context.Context, connection *DBConn, destination interface{}, selectList string, whichConn ...int) []int {
+	missing, err := SelectFromSegmentsContext(ctx, connection, destination, selectList, whichConn...)
+	gplog.FatalOnError(err)
+	return missing
+}
+
+func SelectFromSegmentsContext(ctx context.Context, connection *DBConn, destination interface{}, selectList string, whichConn ...int) ([]int, error) {
+	connNum := connection.ValidateConnNum(whichConn...)
+	destValue := reflect.ValueOf(destination)
+	if destValue.Kind() != reflect.Ptr || destValue.Elem().Kind() != reflect.Map || destValue.Elem().Type().Key().Kind() != reflect.Int || destValue.Elem().IsNil() {
+		return nil, errors.Errorf("Destination must be a pointer to a non-nil map with int keys, not %T", destination)
+	}
+	resultMap := destValue.Elem()
+	resultType := resultMap.Type().Elem()
+
+	query := fmt.Sprintf("SELECT %s AS gp_content_id, %s FROM gp_dist_random('gp_id')", connection.segmentIDExpression(), selectList)
+	rows, err := connection.QueryContext(ctx, query, connNum)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var traversals [][]int
+	if isStructResult(resultType) {
+		traversals = connection.ConnPool[connNum].Mapper.TraversalsByName(resultType, columns[1:])
+		for i, traversal := range traversals {
+			if len(traversal) == 0 {
+				return nil, errors.Errorf("Missing destination name %s in %s", columns[i+1], resultType)
+			}
+		}
+	} else if len(columns) > 2 {
+		return nil, errors.Errorf("Too many columns returned from query: got %d columns, expected 1 column", len(columns)-1)
+	}
+
+	var contentID int
+	for rows.Next() {
+		result := reflect.New(resultType).Elem()
+		values := []interface{}{&contentID}
+		if traversals == nil {
+			values = append(values, result.Addr().Interface())
+		}
+		for _, traversal := range traversals {
+			values = append(values, reflectx.FieldByIndexes(result, traversal).Addr().Interface())
+		}
+		err = rows.Scan(values...)
+		if err != nil {
+			return nil, err
+		}
+		if resultMap.MapIndex(reflect.ValueOf(contentID)).IsValid() {
+			return nil, errors.Errorf("Too many rows returned from segment %d, expected 1 row", contentID)
+		}
+		resultMap.SetMapIndex(reflect.ValueOf(contentID), result)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	contentIDs, err := SelectIntSliceContext(ctx, connection, "SELECT content FROM gp_segment_configuration WHERE role = 'p' AND content >= 0", connNum)
+	if err != nil {
+		return nil, err
+	}
+	missing := make([]int, 0)
+	for _, contentID := range contentIDs {
+		if !resultMap.MapIndex(reflect.ValueOf(int(contentID))).IsValid() {
+			missing = append(missing, int(contentID))
+		}
+	}
+	sort.Ints(missing)
+	return missing, nil
+}
+
+/*
+ * As in sqlx, a struct is scanned field by field unless it can be scanned as a
+ * single value, like a sql.NullString or a time.Time.
+ */
+func isStructResult(resultType reflect.Type) bool {
+	if resultType.Kind() != reflect.Struct || reflect.PtrTo(resultType).Implements(scannerType) {
+		return false
+	}
+	return resultType != reflect.TypeOf(time.Time{})
+}
@@ -0,0 +1,119 @@
+package dbconn_test
+
+import (
+	"regexp"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dbconn/segments tests", func() {
+	segmentQuery := regexp.QuoteMeta("SELECT content FROM gp_segment_configuration WHERE role = 'p' AND content >= 0")
+	segmentRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"content"}).AddRow(0).AddRow(1).AddRow(2)
+	}
+
+	Describe("SelectFromSegments", func() {
+		It("evaluates the select list on each segment and returns the results by content ID", func() {
+			testhelper.SetDBVersion(connection, "6.0.0")
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT gp_execution_segment() AS gp_content_id, current_setting('work_mem') FROM gp_dist_random('gp_id')")).
+				WillReturnRows(sqlmock.NewRows([]string{"gp_content_id", "current_setting"}).AddRow(1, "64MB").AddRow(0, "32MB").AddRow(2, "32MB"))
+			mock.ExpectQuery(segmentQuery).WillReturnRows(segmentRows())
+			results := make(map[int]string)
+
+			missing, err := dbconn.SelectFromSegments(connection, &results, "current_setting('work_mem')")
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(missing).To(BeEmpty())
+			Expect(results).To(Equal(map[int]string{0: "32MB", 1: "64MB", 2: "32MB"}))
+		})
+		It("uses gp_segment_id before GPDB 6", func() {
+			testhelper.SetDBVersion(connection, "5.1.0")
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT gp_segment_id AS gp_content_id, 1 FROM gp_dist_random('gp_id')")).
+				WillReturnRows(sqlmock.NewRows([]string{"gp_content_id", "?column?"}).AddRow(0, 1).AddRow(1, 1).AddRow(2, 1))
+			mock.ExpectQuery(segmentQuery).WillReturnRows(segmentRows())
+			results := make(map[int]int)
+
+			Expect(dbconn.MustSelectFromSegments(connection, &results, "1")).To(BeEmpty())
+			Expect(results).To(Equal(map[int]int{0: 1, 1: 1, 2: 1}))
+		})
+		It("scans multiple columns into a struct", func() {
+			type segmentSize struct {
+				Name string `db:"datname"`
+				Size int64
+			}
+			testhelper.SetDBVersion(connection, "6.0.0")
+			mock.ExpectQuery("SELECT (.*) FROM gp_dist_random").
+				WillReturnRows(sqlmock.NewRows([]string{"gp_content_id", "datname", "size"}).AddRow(0, "postgres", 100).AddRow(1, "postgres", 200).AddRow(2, "postgres", 300))
+			mock.ExpectQuery(segmentQuery).WillReturnRows(segmentRows())
+			results := make(map[int]segmentSize)
+
+			_, err := dbconn.SelectFromSegments(connection, &results, "current_database() AS datname, pg_database_size(current_database()) AS size")
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(results).To(Equal(map[int]segmentSize{0: {"postgres", 100}, 1: {"postgres", 200}, 2: {"postgres", 300}}))
+		})
+		It("returns the segments that did not return a row", func() {
+			testhelper.SetDBVersion(connection, "6.0.0")
+			mock.ExpectQuery("SELECT (.*) FROM gp_dist_random").
+				WillReturnRows(sqlmock.NewRows([]string{"gp_content_id", "pg_ls_dir"}).AddRow(1, "base"))
+			mock.ExpectQuery(segmentQuery).WillReturnRows(segmentRows())
+			results := make(map[int]string)
+
+			missing, err := dbconn.SelectFromSegments(connection, &results, "pg_ls_dir('.')")
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(missing).To(Equal([]int{0, 2}))
+			Expect(results).To(Equal(map[int]string{1: "base"}))
+		})
+		It("returns an error if a segment returns more than one row", func() {
+			testhelper.SetDBVersion(connection, "6.0.0")
+			mock.ExpectQuery("SELECT (.*) FROM gp_dist_random").
+				WillReturnRows(sqlmock.NewRows([]string{"gp_content_id", "pg_ls_dir"}).AddRow(1, "base").AddRow(1, "global"))
+			results := make(map[int]string)
+
+			_, err := dbconn.SelectFromSegments(connection, &results, "pg_ls_dir('.')")
+			Expect(err).To(MatchError("Too many rows returned from segment 1, expected 1 row"))
+		})
+		It("returns an error if the select list has multiple columns and the destination is not a struct", func() {
+			testhelper.SetDBVersion(connection, "6.0.0")
+			mock.ExpectQuery("SELECT (.*) FROM gp_dist_random").
+				WillReturnRows(sqlmock.NewRows([]string{"gp_content_id", "foo", "bar"}).AddRow(0, "one", "two"))
+			results := make(map[int]string)
+
+			_, err := dbconn.SelectFromSegments(connection, &results, "'one' AS foo, 'two' AS bar")
+			Expect(err).To(MatchError("Too many columns returned from query: got 2 columns, expected 1 column"))
+		})
+		It("returns an error if a column has no matching struct field", func() {
+			type result struct {
+				Foo string
+			}
+			testhelper.SetDBVersion(connection, "6.0.0")
+			mock.ExpectQuery("SELECT (.*) FROM gp_dist_random").
+				WillReturnRows(sqlmock.NewRows([]string{"gp_content_id", "foo", "bar"}).AddRow(0, "one", "two"))
+			results := make(map[int]result)
+
+			_, err := dbconn.SelectFromSegments(connection, &results, "'one' AS foo, 'two' AS bar")
+			Expect(err).To(MatchError("Missing destination name bar in dbconn_test.result"))
+		})
+		It("returns an error if the destination is not a pointer to a map", func() {
+			results := make(map[int]string)
+
+			_, err := dbconn.SelectFromSegments(connection, results, "1")
+			Expect(err).To(MatchError("Destination must be a pointer to a non-nil map with int keys, not map[int]string"))
+		})
+		It("returns the error from the query", func() {
+			testhelper.SetDBVersion(connection, "6.0.0")
+			mock.ExpectQuery("SELECT (.*) FROM gp_dist_random").WillReturnError(errors.New("function does not exist"))
+			results := make(map[int]string)
+
+			_, err := dbconn.SelectFromSegments(connection, &results, "foo()")
+			Expect(err).To(MatchError("function does not exist"))
+		})
+	})
+})
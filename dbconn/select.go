@@ -0,0 +1,201 @@
+package dbconn
+
+/*
+ * This file contains convenience functions for selecting a single value or a
+ * single column of values of types other than strings.  Like SelectString and
+ * SelectStringSlice, they return an error if a query returns more than one
+ * column, or more than one row when selecting a single value, and treat NULL or
+ * a missing row as the zero value of the type.
+ */
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/pkg/errors"
+)
+
+/*
+ * Runs a query expected to return a single column, calling scanRow for each
+ * row, and closes the rows before returning.
+ */
+func selectColumnContext(ctx context.Context, connection *DBConn, query string, connNum int, scanRow func(rows *sql.Rows) error) error {
+	rows, err := connection.QueryContext(ctx, query, connNum)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if cols, _ := rows.Rows.Columns(); len(cols) > 1 {
+		return errors.Errorf("Too many columns returned from query: got %d columns, expected 1 column", len(cols))
+	}
+	for rows.Rows.Next() {
+		err = scanRow(rows.Rows)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Rows.Err()
+}
+
+func checkSingleRow(numRows int) error {
+	if numRows > 1 {
+		return errors.Errorf("Too many rows returned from query: got %d rows, expected 1 row", numRows)
+	}
+	return nil
+}
+
+/*
+ * Scans a single value into any sql.Scanner, such as a sql.NullTime or a
+ * custom type.  If the query returns no rows, the destination scans a NULL
+ * value, as if the query had returned NULL.
+ */
+func MustSelectScanner(connection *DBConn, destination sql.Scanner, query string, whichConn ...int) {
+	err := SelectScanner(connection, destination, query, whichConn...)
+	gplog.FatalOnError(err)
+}
+
+func SelectScanner(connection *DBConn, destination sql.Scanner, query string, whichConn ...int) error {
+	return SelectScannerContext(context.Background(), connection, destination, query, whichConn...)
+}
+
+func MustSelectScannerContext(ctx context.Context, connection *DBConn, destination sql.Scanner, query string, whichConn ...int) {
+	err := SelectScannerContext(ctx, connection, destination, query, whichConn...)
+	gplog.FatalOnError(err)
+}
+
+func SelectScannerContext(ctx context.Context, connection *DBConn, destination sql.Scanner, query string, whichConn ...int) error {
+	connNum := connection.ValidateConnNum(whichConn...)
+	numRows := 0
+	err := selectColumnContext(ctx, connection, query, connNum, func(rows *sql.Rows) error {
+		numRows++
+		if numRows == 1 {
+			return rows.Scan(destination)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = checkSingleRow(numRows); err != nil {
+		return err
+	}
+	if numRows == 0 {
+		return destination.Scan(nil)
+	}
+	return nil
+}
+
+func MustSelectInt(connection *DBConn, query string, whichConn ...int) int64 {
+	result, err := SelectInt(connection, query, whichConn...)
+	gplog.FatalOnError(err)
+	return result
+}
+
+func SelectInt(connection *DBConn, query string, whichConn ...int) (int64, error) {
+	return SelectIntContext(context.Background(), connection, query, whichConn...)
+}
+
+func MustSelectIntContext(ctx context.Context, connection *DBConn, query string, whichConn ...int) int64 {
+	result, err := SelectIntContext(ctx, connection, query, whichConn...)
+	gplog.FatalOnError(err)
+	return result
+}
+
+func SelectIntContext(ctx context.Context, connection *DBConn, query string, whichConn ...int) (int64, error) {
+	results, err := SelectIntSliceContext(ctx, connection, query, whichConn...)
+	if err != nil {
+		return 0, err
+	}
+	if err = checkSingleRow(len(results)); err != nil {
+		return 0, err
+	}
+	if len(results) == 1 {
+		return results[0], nil
+	}
+	return 0, nil
+}
+
+func MustSelectIntSlice(connection *DBConn, query string, whichConn ...int) []int64 {
+	results, err := SelectIntSlice(connection, query, whichConn...)
+	gplog.FatalOnError(err)
+	return results
+}
+
+func SelectIntSlice(connection *DBConn, query string, whichConn ...int) ([]int64, error) {
+	return SelectIntSliceContext(context.Background(), connection, query, whichConn...)
+}
+
+func MustSelectIntSliceContext(ctx context.Context, connection *DBConn, query string, whichConn ...int) []int64 {
+	results, err := SelectIntSliceContext(ctx, connection, query, whichConn...)
+	gplog.FatalOnError(err)
+	return results
+}
+
+func SelectIntSliceContext(ctx context.Context, connection *DBConn, query string, whichConn ...int) ([]int64, error) {
+	connNum := connection.ValidateConnNum(whichConn...)
+	retval := make([]int64, 0)
+	err := selectColumnContext(ctx, connection, query, connNum, func(rows *sql.Rows) error {
+		var result sql.NullInt64
+		err := rows.Scan(&result)
+		retval = append(retval, result.Int64)
+		return err
+	})
+	if err != nil {
+		return []int64{}, err
+	}
+	return retval, nil
+}
+
+func MustSelectBool(connection *DBConn, query string, whichConn ...int) bool {
+	result, err := SelectBool(connection, query, whichConn...)
+	gplog.FatalOnError(err)
+	return result
+}
+
+func SelectBool(connection *DBConn, query string, whichConn ...int) (bool, error) {
+	return SelectBoolContext(context.Background(), connection, query, whichConn...)
+}
+
+func MustSelectBoolContext(ctx context.Context, connection *DBConn, query string, whichConn ...int) bool {
+	result, err := SelectBoolContext(ctx, connection, query, whichConn...)
+	gplog.FatalOnError(err)
+	return result
+}
+
+func SelectBoolContext(ctx context.Context, connection *DBConn, query string, whichConn ...int) (bool, error) {
+	var result sql.NullBool
+	err := SelectScannerContext(ctx, connection, &result, query, whichConn...)
+	if err != nil {
+		return false, err
+	}
+	return result.Bool, nil
+}
+
+func MustSelectOidSlice(connection *DBConn, query string, whichConn ...int) []uint32 {
+	results, err := SelectOidSlice(connection, query, whichConn...)
+	gplog.FatalOnError(err)
+	return results
+}
+
+func SelectOidSlice(connection *DBConn, query string, whichConn ...int) ([]uint32, error) {
+	return SelectOidSliceContext(context.Background(), connection, query, whichConn...)
+}
+
+func MustSelectOidSliceContext(ctx context.Context, connection *DBConn, query string, whichConn ...int) []uint32 {
+	results, err := SelectOidSliceContext(ctx, connection, query, whichConn...)
+	gplog.FatalOnError(err)
+	return results
+}
+
+func SelectOidSliceContext(ctx context.Context, connection *DBConn, query string, whichConn ...int) ([]uint32, error) {
+	results, err := SelectIntSliceContext(ctx, connection, query, whichConn...)
+	if err != nil {
+		return []uint32{}, err
+	}
+	oids := make([]uint32, len(results))
+	for i, result := range results {
+		oids[i] = uint32(result)
+	}
+	return oids, nil
+}
@@ -0,0 +1,141 @@
+package dbconn_test
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dbconn/select tests", func() {
+	header := []string{"foo"}
+	headerExtraCol := []string{"foo", "bar"}
+
+	Describe("SelectScanner", func() {
+		It("scans a single value into the destination", func() {
+			timestamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header).AddRow(timestamp))
+			var result sql.NullTime
+
+			err := dbconn.SelectScanner(connection, &result, "SELECT now()")
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(Equal(sql.NullTime{Time: timestamp, Valid: true}))
+		})
+		It("scans NULL if the query selects NULL", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header).AddRow(nil))
+			result := sql.NullInt64{Int64: 1, Valid: true}
+
+			Expect(dbconn.SelectScanner(connection, &result, "SELECT NULL")).To(Succeed())
+			Expect(result.Valid).To(BeFalse())
+		})
+		It("scans NULL if the query selects no rows", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header))
+			result := sql.NullInt64{Int64: 1, Valid: true}
+
+			Expect(dbconn.SelectScanner(connection, &result, "SELECT foo FROM bar")).To(Succeed())
+			Expect(result.Valid).To(BeFalse())
+		})
+		It("returns an error if the query selects multiple rows", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header).AddRow(1).AddRow(2).AddRow(3))
+			var result sql.NullInt64
+
+			err := dbconn.SelectScanner(connection, &result, "SELECT foo FROM bar")
+			Expect(err).To(MatchError("Too many rows returned from query: got 3 rows, expected 1 row"))
+		})
+		It("returns an error if the query selects multiple columns", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(headerExtraCol).AddRow(1, 2))
+			var result sql.NullInt64
+
+			err := dbconn.SelectScanner(connection, &result, "SELECT foo, bar FROM baz")
+			Expect(err).To(MatchError("Too many columns returned from query: got 2 columns, expected 1 column"))
+		})
+		It("returns an error if the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			var result sql.NullInt64
+
+			err := dbconn.SelectScannerContext(ctx, connection, &result, "SELECT foo FROM bar")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("SelectInt", func() {
+		It("returns a single int", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header).AddRow(int64(42)))
+			Expect(dbconn.MustSelectInt(connection, "SELECT count(*) FROM bar")).To(Equal(int64(42)))
+		})
+		It("returns 0 if the query selects NULL or no rows", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header).AddRow(nil))
+			Expect(dbconn.MustSelectInt(connection, "SELECT NULL")).To(Equal(int64(0)))
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header))
+			Expect(dbconn.MustSelectInt(connection, "SELECT foo FROM bar")).To(Equal(int64(0)))
+		})
+		It("panics if the query selects multiple rows", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header).AddRow(1).AddRow(2))
+			defer testhelper.ShouldPanicWithMessage("Too many rows returned from query: got 2 rows, expected 1 row")
+			dbconn.MustSelectInt(connection, "SELECT foo FROM bar")
+		})
+		It("returns an error if the value is not an integer", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header).AddRow("one"))
+			_, err := dbconn.SelectInt(connection, "SELECT foo FROM bar")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("SelectIntSlice", func() {
+		It("returns a slice of ints with NULLs as 0", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header).AddRow(1).AddRow(nil).AddRow(-3))
+			Expect(dbconn.MustSelectIntSlice(connection, "SELECT foo FROM bar")).To(Equal([]int64{1, 0, -3}))
+		})
+		It("returns an empty slice if the query selects no rows", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header))
+			Expect(dbconn.MustSelectIntSlice(connection, "SELECT foo FROM bar")).To(Equal([]int64{}))
+		})
+		It("returns an error if the query selects multiple columns", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(headerExtraCol).AddRow(1, 2))
+			results, err := dbconn.SelectIntSlice(connection, "SELECT foo, bar FROM baz")
+			Expect(err).To(MatchError("Too many columns returned from query: got 2 columns, expected 1 column"))
+			Expect(results).To(Equal([]int64{}))
+		})
+		It("returns an error if reading the rows fails", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header).AddRow(1).AddRow(2).RowError(1, errors.New("read failed")))
+			_, err := dbconn.SelectIntSlice(connection, "SELECT foo FROM bar")
+			Expect(err).To(MatchError("read failed"))
+		})
+	})
+	Describe("SelectBool", func() {
+		It("returns a single bool", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header).AddRow(true))
+			Expect(dbconn.MustSelectBool(connection, "SELECT true")).To(BeTrue())
+		})
+		It("returns false if the query selects NULL or no rows", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header).AddRow(nil))
+			Expect(dbconn.MustSelectBool(connection, "SELECT NULL")).To(BeFalse())
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header))
+			Expect(dbconn.MustSelectBool(connection, "SELECT foo FROM bar")).To(BeFalse())
+		})
+		It("returns an error if the query selects multiple rows", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header).AddRow(true).AddRow(false))
+			_, err := dbconn.SelectBool(connection, "SELECT foo FROM bar")
+			Expect(err).To(MatchError("Too many rows returned from query: got 2 rows, expected 1 row"))
+		})
+	})
+	Describe("SelectOidSlice", func() {
+		It("returns a slice of oids", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(header).AddRow(uint32(16384)).AddRow(uint32(4294967295)).AddRow(nil))
+			Expect(dbconn.MustSelectOidSlice(connection, "SELECT oid FROM pg_class")).To(Equal([]uint32{16384, 4294967295, 0}))
+		})
+		It("returns an error if the query selects multiple columns", func() {
+			mock.ExpectQuery("SELECT (.*)").WillReturnRows(sqlmock.NewRows(headerExtraCol).AddRow(1, 2))
+			results, err := dbconn.SelectOidSlice(connection, "SELECT oid, relname FROM pg_class")
+			Expect(err).To(MatchError("Too many columns returned from query: got 2 columns, expected 1 column"))
+			Expect(results).To(Equal([]uint32{}))
+		})
+	})
+})
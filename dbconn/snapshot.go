@@ -0,0 +1,103 @@
+package dbconn
+
+/*
+ * This file contains functions related to giving the transactions on all of
+ * the connections in a DBConn the same snapshot.
+ */
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/pkg/errors"
+)
+
+/*
+ * Exporting a snapshot requires Postgres 9.2, and GPDB only supports it with
+ * distributed snapshots as of 6.21.
+ */
+func (dbconn *DBConn) SupportsSynchronizedSnapshots() bool {
+	if _, ok := dbconn.Version.gpdbVersion(); ok {
+		return dbconn.Version.GPDBAtLeast("6.21.0")
+	}
+	return dbconn.Version.PostgresVersion.GTE(semver.Version{Major: 9, Minor: 2})
+}
+
+func (dbconn *DBConn) MustBeginSynchronized(options TxOptions) string {
+	snapshotID, err := dbconn.BeginSynchronized(options)
+	gplog.FatalOnError(err)
+	return snapshotID
+}
+
+/*
+ * Begins a transaction with the given options on every connection, and if the
+ * database supports it, exports the snapshot of the transaction on connection
+ * 0 and imports it into the transactions on the other connections, so that
+ * parallel workers all see the same data.  It returns the exported snapshot
+ * ID, or an empty string if synchronized snapshots are not supported, in which
+ * case each transaction has its own snapshot.
+ *
+ * An Isolation of sql.LevelDefault means SERIALIZABLE, as with Begin, and
+ * lower isolation levels are not allowed, as they take a new snapshot for each
+ * statement.  The snapshot only remains valid for new transactions while the
+ * transaction on connection 0 is in progress, so it should be committed last.
+ * If any transaction cannot be begun, all of them are rolled back.
+ */
+func (dbconn *DBConn) BeginSynchronized(options TxOptions) (snapshotID string, err error) {
+	if options.Isolation == sql.LevelDefault {
+		options.Isolation = sql.LevelSerializable
+	}
+	if options.Isolation != sql.LevelRepeatableRead && options.Isolation != sql.LevelSerializable {
+		return "", errors.Errorf("Synchronized transactions must be REPEATABLE READ or SERIALIZABLE, not %s", options.Isolation)
+	}
+	for connNum := 0; connNum < dbconn.NumConns; connNum++ {
+		if dbconn.Tx[connNum] != nil {
+			return "", errors.Errorf("Cannot begin synchronized transactions; there is already a transaction in progress on connection %d", connNum)
+		}
+	}
+	defer func() {
+		if err != nil {
+			dbconn.rollbackAll()
+		}
+	}()
+
+	err = dbconn.BeginWithOptions(options, 0)
+	if err != nil {
+		return "", err
+	}
+	if dbconn.SupportsSynchronizedSnapshots() {
+		snapshotID, err = SelectString(dbconn, "SELECT pg_export_snapshot()", 0)
+		if err != nil {
+			return "", errors.Wrap(err, "Unable to export snapshot")
+		}
+	} else {
+		gplog.Verbose("Synchronized snapshots are not supported in GPDB %s; each connection will use its own snapshot", dbconn.Version.VersionString)
+	}
+	for connNum := 1; connNum < dbconn.NumConns; connNum++ {
+		err = dbconn.BeginWithOptions(options, connNum)
+		if err != nil {
+			return "", err
+		}
+		if snapshotID != "" {
+			_, err = dbconn.Exec("SET TRANSACTION SNAPSHOT "+quoteLiteral(snapshotID), connNum)
+			if err != nil {
+				return "", errors.Wrapf(err, "Unable to import snapshot %s on connection %d", snapshotID, connNum)
+			}
+		}
+	}
+	return snapshotID, nil
+}
+
+func (dbconn *DBConn) rollbackAll() {
+	for connNum := 0; connNum < dbconn.NumConns; connNum++ {
+		if dbconn.Tx[connNum] != nil {
+			_ = dbconn.Rollback(connNum)
+		}
+	}
+}
+
+func quoteLiteral(str string) string {
+	return "'" + strings.Replace(str, "'", "''", -1) + "'"
+}
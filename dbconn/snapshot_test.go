@@ -0,0 +1,112 @@
+package dbconn_test
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dbconn/snapshot tests", func() {
+	fakeResult := testhelper.TestResult{Rows: 0}
+	snapshotID := "00000003-0000001B-1"
+	expectBeginWithIsolation := func(isolation string) {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("SET TRANSACTION ISOLATION LEVEL " + isolation)).WillReturnResult(fakeResult)
+	}
+
+	BeforeEach(func() {
+		connection, mock = createAndConnectSeparateMockDB(3)
+		testhelper.SetDBVersion(connection, "6.21.0")
+	})
+	Describe("DBConn.SupportsSynchronizedSnapshots", func() {
+		It("returns true for GPDB 6.21 and later", func() {
+			Expect(connection.SupportsSynchronizedSnapshots()).To(BeTrue())
+		})
+		It("returns false for earlier versions", func() {
+			testhelper.SetDBVersion(connection, "6.20.3")
+			Expect(connection.SupportsSynchronizedSnapshots()).To(BeFalse())
+		})
+		It("returns true for Cloudberry", func() {
+			connection.Version, _ = dbconn.ParseVersion("PostgreSQL 14.4 (Apache Cloudberry 1.6.0 build 1)", "140004")
+			Expect(connection.SupportsSynchronizedSnapshots()).To(BeTrue())
+		})
+		It("depends on the PostgreSQL version for PostgreSQL", func() {
+			connection.Version, _ = dbconn.ParseVersion("PostgreSQL 9.2.24 on x86_64-pc-linux-gnu", "90224")
+			Expect(connection.SupportsSynchronizedSnapshots()).To(BeTrue())
+			connection.Version, _ = dbconn.ParseVersion("PostgreSQL 9.1.24 on x86_64-pc-linux-gnu", "90124")
+			Expect(connection.SupportsSynchronizedSnapshots()).To(BeFalse())
+		})
+	})
+	Describe("DBConn.BeginSynchronized", func() {
+		It("exports the snapshot from connection 0 and imports it on the other connections", func() {
+			expectBeginWithIsolation("SERIALIZABLE")
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_export_snapshot()")).WillReturnRows(sqlmock.NewRows([]string{"pg_export_snapshot"}).AddRow(snapshotID))
+			for i := 1; i < 3; i++ {
+				expectBeginWithIsolation("SERIALIZABLE")
+				mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s'", snapshotID))).WillReturnResult(fakeResult)
+			}
+
+			result, err := connection.BeginSynchronized(dbconn.TxOptions{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(Equal(snapshotID))
+			for i := 0; i < 3; i++ {
+				Expect(connection.Tx[i]).ToNot(BeNil())
+			}
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("begins transactions without a shared snapshot if synchronized snapshots are not supported", func() {
+			testhelper.SetDBVersion(connection, "5.1.0")
+			for i := 0; i < 3; i++ {
+				expectBeginWithIsolation("REPEATABLE READ, READ ONLY")
+			}
+
+			result, err := connection.BeginSynchronized(dbconn.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(Equal(""))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("rolls back all transactions if the snapshot cannot be imported", func() {
+			expectBeginWithIsolation("SERIALIZABLE")
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_export_snapshot()")).WillReturnRows(sqlmock.NewRows([]string{"pg_export_snapshot"}).AddRow(snapshotID))
+			expectBeginWithIsolation("SERIALIZABLE")
+			mock.ExpectExec("SET TRANSACTION SNAPSHOT (.*)").WillReturnError(fmt.Errorf("invalid snapshot identifier"))
+			mock.ExpectRollback()
+			mock.ExpectRollback()
+
+			_, err := connection.BeginSynchronized(dbconn.TxOptions{})
+			Expect(err).To(MatchError(fmt.Sprintf("Unable to import snapshot %s on connection 1: invalid snapshot identifier", snapshotID)))
+			for i := 0; i < 3; i++ {
+				Expect(connection.Tx[i]).To(BeNil())
+			}
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("rolls back if the snapshot cannot be exported", func() {
+			expectBeginWithIsolation("SERIALIZABLE")
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_export_snapshot()")).WillReturnError(fmt.Errorf("function does not exist"))
+			mock.ExpectRollback()
+
+			_, err := connection.BeginSynchronized(dbconn.TxOptions{})
+			Expect(err).To(MatchError("Unable to export snapshot: function does not exist"))
+			Expect(connection.Tx[0]).To(BeNil())
+		})
+		It("returns an error for an isolation level that does not use a single snapshot", func() {
+			_, err := connection.BeginSynchronized(dbconn.TxOptions{Isolation: sql.LevelReadCommitted})
+			Expect(err).To(MatchError("Synchronized transactions must be REPEATABLE READ or SERIALIZABLE, not Read Committed"))
+		})
+		It("returns an error if a transaction is already in progress", func() {
+			ExpectBegin(mock)
+			connection.MustBegin(2)
+
+			_, err := connection.BeginSynchronized(dbconn.TxOptions{})
+			Expect(err).To(MatchError("Cannot begin synchronized transactions; there is already a transaction in progress on connection 2"))
+			Expect(connection.Tx[2]).ToNot(BeNil())
+		})
+	})
+})
@@ -0,0 +1,123 @@
+package dbconn
+
+/*
+ * This file contains structs and functions for observing the connections in a
+ * DBConn as they are opened, used, and closed.
+ */
+
+import (
+	"time"
+
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+ * Counts what has happened on a single connection since the DBConn was last
+ * connected; reconnecting a single connection does not reset its counters.
+ * BusyTime is the total time spent running statements, which for Query only
+ * includes the time until the first rows are returned.
+ */
+type ConnStats struct {
+	Connected     bool
+	InTransaction bool
+	ConnectedAt   time.Time
+	Connects      int
+	Queries       int64
+	FailedQueries int64
+	Transactions  int64
+	BusyTime      time.Duration
+}
+
+/*
+ * Holds the counters for each connection, indexed by connection number, along
+ * with the number of connections that have a transaction in progress.
+ */
+type PoolStats struct {
+	Connections   []ConnStats
+	InTransaction int
+}
+
+/*
+ * Returns a snapshot of the counters for each connection.  This is safe to
+ * call from another goroutine while the connections are in use.  The counters
+ * are kept after Close, with every connection marked as not connected, until
+ * the DBConn is connected again.
+ */
+func (dbconn *DBConn) Stats() PoolStats {
+	dbconn.statsLock.Lock()
+	defer dbconn.statsLock.Unlock()
+	stats := PoolStats{Connections: make([]ConnStats, len(dbconn.connStats))}
+	copy(stats.Connections, dbconn.connStats)
+	for _, connStats := range stats.Connections {
+		if connStats.InTransaction {
+			stats.InTransaction++
+		}
+	}
+	return stats
+}
+
+func (dbconn *DBConn) resetStats(numConns int) {
+	dbconn.statsLock.Lock()
+	defer dbconn.statsLock.Unlock()
+	dbconn.connStats = make([]ConnStats, numConns)
+}
+
+func (dbconn *DBConn) updateStats(connNum int, update func(connStats *ConnStats)) {
+	dbconn.statsLock.Lock()
+	defer dbconn.statsLock.Unlock()
+	if connNum < len(dbconn.connStats) {
+		update(&dbconn.connStats[connNum])
+	}
+}
+
+/*
+ * The OnConnect and OnClose hooks are called from the goroutine that opened or
+ * closed the connection, after the fact, so they must not block for long.
+ */
+func (dbconn *DBConn) connectionOpened(connNum int, conn *sqlx.DB) {
+	dbconn.ConnPool[connNum] = conn
+	dbconn.updateStats(connNum, func(connStats *ConnStats) {
+		connStats.Connected = true
+		connStats.ConnectedAt = operating.System.Now()
+		connStats.Connects++
+	})
+	if dbconn.OnConnect != nil {
+		dbconn.OnConnect(connNum, dbconn.backendPID(connNum))
+	}
+}
+
+func (dbconn *DBConn) connectionClosed(connNum int, backendPID int) {
+	dbconn.updateStats(connNum, func(connStats *ConnStats) {
+		connStats.Connected = false
+		connStats.InTransaction = false
+	})
+	if dbconn.OnClose != nil {
+		dbconn.OnClose(connNum, backendPID)
+	}
+}
+
+/*
+ * All changes to the transaction in progress on a connection go through here
+ * so that Stats can report it without racing with the goroutine using the
+ * connection.
+ */
+func (dbconn *DBConn) setTx(connNum int, tx *sqlx.Tx) {
+	dbconn.Tx[connNum] = tx
+	dbconn.updateStats(connNum, func(connStats *ConnStats) {
+		if tx != nil && !connStats.InTransaction {
+			connStats.Transactions++
+		}
+		connStats.InTransaction = tx != nil
+	})
+}
+
+func (dbconn *DBConn) recordQuery(info QueryInfo) {
+	dbconn.updateStats(info.ConnNum, func(connStats *ConnStats) {
+		connStats.Queries++
+		if info.Err != nil {
+			connStats.FailedQueries++
+		}
+		connStats.BusyTime += info.Duration
+	})
+}
@@ -0,0 +1,122 @@
+package dbconn_test
+
+import (
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/greenplum-db/gp-common-go-libs/operating"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+	"github.com/pkg/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dbconn/stats tests", func() {
+	BeforeEach(func() {
+		// Each call to Now is a second later than the last, so every query takes one second
+		now := time.Date(2017, time.January, 1, 1, 1, 1, 1, time.Local)
+		operating.System.Now = func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		}
+	})
+	AfterEach(func() {
+		operating.System = operating.InitializeSystemFunctions()
+	})
+	Describe("DBConn.Stats", func() {
+		BeforeEach(func() {
+			connection, mock = createAndConnectSeparateMockDB(2)
+		})
+		It("counts the statements run on each connection and how long they took", func() {
+			mock.ExpectExec("DELETE FROM foo").WillReturnResult(testhelper.TestResult{Rows: 1})
+			mock.ExpectQuery("SELECT foo FROM bar").WillReturnRows(sqlmock.NewRows([]string{"foo"}).AddRow("one"))
+			mock.ExpectExec("DELETE FROM baz").WillReturnError(errors.New("permission denied"))
+
+			connection.MustExec("DELETE FROM foo", 1)
+			_, _ = dbconn.SelectStringSlice(connection, "SELECT foo FROM bar", 1)
+			_, _ = connection.Exec("DELETE FROM baz", 1)
+
+			stats := connection.Stats()
+			Expect(stats.Connections).To(HaveLen(2))
+			Expect(stats.Connections[0].Queries).To(Equal(int64(1))) // the version query
+			Expect(stats.Connections[1].Queries).To(Equal(int64(3)))
+			Expect(stats.Connections[1].FailedQueries).To(Equal(int64(1)))
+			Expect(stats.Connections[1].BusyTime).To(Equal(3 * time.Second))
+		})
+		It("reports which connections have a transaction in progress", func() {
+			ExpectBegin(mock)
+			ExpectBegin(mock)
+			mock.ExpectCommit()
+
+			connection.MustBegin(0)
+			connection.MustBegin(1)
+			Expect(connection.Stats().InTransaction).To(Equal(2))
+
+			connection.MustCommit(0)
+			stats := connection.Stats()
+			Expect(stats.InTransaction).To(Equal(1))
+			Expect(stats.Connections[0].InTransaction).To(BeFalse())
+			Expect(stats.Connections[0].Transactions).To(Equal(int64(1)))
+			Expect(stats.Connections[1].InTransaction).To(BeTrue())
+		})
+		It("keeps the counters when a connection is reconnected", func() {
+			mock.ExpectExec("DELETE FROM foo").WillReturnResult(testhelper.TestResult{Rows: 1})
+			connection.MustExec("DELETE FROM foo", 1)
+			firstConnectedAt := connection.Stats().Connections[1].ConnectedAt
+
+			Expect(connection.Reconnect(1)).To(Succeed())
+
+			connStats := connection.Stats().Connections[1]
+			Expect(connStats.Connected).To(BeTrue())
+			Expect(connStats.Connects).To(Equal(2))
+			Expect(connStats.ConnectedAt).To(BeTemporally(">", firstConnectedAt))
+			Expect(connStats.Queries).To(Equal(int64(1)))
+		})
+		It("keeps the counters after the connection is closed", func() {
+			mock.ExpectExec("DELETE FROM foo").WillReturnResult(testhelper.TestResult{Rows: 1})
+			connection.MustExec("DELETE FROM foo", 1)
+
+			connection.Close()
+
+			stats := connection.Stats()
+			Expect(stats.Connections).To(HaveLen(2))
+			Expect(stats.Connections[1].Connected).To(BeFalse())
+			Expect(stats.Connections[1].Queries).To(Equal(int64(1)))
+		})
+	})
+	Describe("OnConnect and OnClose", func() {
+		var opened, closed []int
+
+		BeforeEach(func() {
+			opened, closed = make([]int, 0), make([]int, 0)
+			db, newMock := testhelper.CreateMockDB()
+			testhelper.ExpectVersionQuery(newMock, "5.1.0")
+			connection = dbconn.NewDBConn("testdb", "testrole", "testhost", 5432)
+			connection.Driver = testhelper.TestDriver{DB: db}
+			connection.OnConnect = func(connNum int, backendPID int) {
+				opened = append(opened, connNum)
+			}
+			connection.OnClose = func(connNum int, backendPID int) {
+				closed = append(closed, connNum)
+			}
+			connection.MustConnect(2)
+		})
+		It("calls OnConnect as each connection is opened", func() {
+			Expect(opened).To(Equal([]int{0, 1}))
+			Expect(closed).To(BeEmpty())
+		})
+		It("calls OnClose as each connection is closed", func() {
+			connection.Close()
+
+			Expect(closed).To(Equal([]int{0, 1}))
+		})
+		It("calls OnClose and then OnConnect when a connection is reconnected", func() {
+			Expect(connection.Reconnect(1)).To(Succeed())
+
+			Expect(closed).To(Equal([]int{1}))
+			Expect(opened).To(Equal([]int{0, 1, 1}))
+		})
+	})
+})
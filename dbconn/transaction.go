@@ -0,0 +1,240 @@
+package dbconn
+
+/*
+ * This file contains structs and functions related to beginning transactions
+ * with particular characteristics, to running functions inside transactions,
+ * and to savepoints within transactions.
+ */
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/blang/semver"
+	"github.com/greenplum-db/gp-common-go-libs/gplog"
+	"github.com/pkg/errors"
+)
+
+/*
+ * These correspond to the transaction modes of SET TRANSACTION.  An Isolation
+ * of sql.LevelDefault uses the server's default isolation level, so the zero
+ * value of TxOptions begins a transaction exactly as BEGIN would; note that
+ * this differs from Begin, which always uses SERIALIZABLE.
+ *
+ * DEFERRABLE only has an effect on SERIALIZABLE, READ ONLY transactions, and is
+ * not supported by GPDB versions before 6.
+ */
+type TxOptions struct {
+	Isolation  sql.IsolationLevel
+	ReadOnly   bool
+	Deferrable bool
+}
+
+var isolationLevels = map[sql.IsolationLevel]string{
+	sql.LevelReadUncommitted: "READ UNCOMMITTED",
+	sql.LevelReadCommitted:   "READ COMMITTED",
+	sql.LevelRepeatableRead:  "REPEATABLE READ",
+	sql.LevelSerializable:    "SERIALIZABLE",
+}
+
+/*
+ * Returns the SET TRANSACTION statement for the given options, or an empty
+ * string if the options do not require one.
+ */
+func (dbconn *DBConn) setTransactionStatement(options TxOptions) (string, error) {
+	modes := make([]string, 0)
+	if options.Isolation != sql.LevelDefault {
+		level, ok := isolationLevels[options.Isolation]
+		if !ok {
+			return "", errors.Errorf("Isolation level %s is not supported", options.Isolation)
+		}
+		modes = append(modes, "ISOLATION LEVEL "+level)
+	}
+	if options.ReadOnly {
+		modes = append(modes, "READ ONLY")
+	}
+	if options.Deferrable {
+		if dbconn.Version.GPDBBefore("6") {
+			return "", errors.New("Deferrable transactions are not supported before GPDB 6")
+		}
+		if _, ok := dbconn.Version.gpdbVersion(); !ok && dbconn.Version.PostgresVersion.LT(semver.Version{Major: 9, Minor: 1}) {
+			return "", errors.New("Deferrable transactions are not supported before PostgreSQL 9.1")
+		}
+		modes = append(modes, "DEFERRABLE")
+	}
+	if len(modes) == 0 {
+		return "", nil
+	}
+	return "SET TRANSACTION " + strings.Join(modes, ", "), nil
+}
+
+func (dbconn *DBConn) MustBeginWithOptions(options TxOptions, whichConn ...int) {
+	err := dbconn.BeginWithOptions(options, whichConn...)
+	gplog.FatalOnError(err)
+}
+
+func (dbconn *DBConn) BeginWithOptions(options TxOptions, whichConn ...int) error {
+	return dbconn.BeginWithOptionsContext(context.Background(), options, whichConn...)
+}
+
+func (dbconn *DBConn) BeginWithOptionsContext(ctx context.Context, options TxOptions, whichConn ...int) error {
+	connNum := dbconn.ValidateConnNum(whichConn...)
+	if dbconn.Tx[connNum] != nil {
+		return errors.New("Cannot begin transaction; there is already a transaction in progress")
+	}
+	setTransaction, err := dbconn.setTransactionStatement(options)
+	if err != nil {
+		return err
+	}
+	tx, err := dbconn.ConnPool[connNum].BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	dbconn.setTx(connNum, tx)
+	if setTransaction != "" {
+		_, err = dbconn.ExecContext(ctx, setTransaction, connNum)
+	}
+	return err
+}
+
+/*
+ * Runs txFunc in a serializable transaction on the given connection, which is
+ * committed if txFunc returns nil and rolled back if it returns an error or
+ * panics; the error is returned or the panic continues after the rollback.
+ * Queries in txFunc should use the same connection, and txFunc should not
+ * commit or roll back the transaction itself.
+ */
+func (dbconn *DBConn) WithTransaction(connNum int, txFunc func() error) error {
+	return dbconn.WithTransactionOptions(connNum, TxOptions{Isolation: sql.LevelSerializable}, 0, txFunc)
+}
+
+/*
+ * This behaves like WithTransaction, but begins the transaction with the given
+ * options, and if the transaction fails with a serialization failure (SQLSTATE
+ * 40001), runs the whole transaction again up to maxRetries times, so txFunc
+ * must be safe to run more than once.
+ */
+func (dbconn *DBConn) WithTransactionOptions(connNum int, options TxOptions, maxRetries int, txFunc func() error) error {
+	connNum = dbconn.ValidateConnNum(connNum)
+	for attempt := 0; ; attempt++ {
+		err := dbconn.runTransaction(connNum, options, txFunc)
+		if err == nil || attempt >= maxRetries || !IsSerializationFailure(err) {
+			return err
+		}
+		gplog.Verbose("Retrying transaction on connection %d after serialization failure: %v", connNum, err)
+	}
+}
+
+/*
+ * If txFunc fails, the error from rolling back (most likely due to a lost
+ * connection) is only logged, as the original error is more useful and must
+ * be preserved to detect serialization failures; the transaction is no longer
+ * in progress either way.
+ */
+func (dbconn *DBConn) runTransaction(connNum int, options TxOptions, txFunc func() error) (err error) {
+	alreadyInProgress := dbconn.Tx[connNum] != nil
+	err = dbconn.BeginWithOptions(options, connNum)
+	if err != nil {
+		if !alreadyInProgress && dbconn.Tx[connNum] != nil {
+			_ = dbconn.Rollback(connNum)
+		}
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			if rollbackErr := dbconn.Rollback(connNum); rollbackErr != nil {
+				gplog.Verbose("Unable to roll back transaction on connection %d: %v", connNum, rollbackErr)
+			}
+		}
+	}()
+	err = txFunc()
+	if err != nil {
+		return err
+	}
+	committed = true
+	return dbconn.Commit(connNum)
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+/*
+ * Savepoint names are quoted, so they are case-sensitive.  As in Postgres,
+ * creating a savepoint with the same name as an existing one hides the older
+ * savepoint until the newer one is released.
+ */
+func (dbconn *DBConn) MustSavepoint(name string, whichConn ...int) {
+	err := dbconn.Savepoint(name, whichConn...)
+	gplog.FatalOnError(err)
+}
+
+func (dbconn *DBConn) Savepoint(name string, whichConn ...int) error {
+	return dbconn.execInTransaction("create savepoint", "SAVEPOINT "+quoteIdentifier(name), whichConn...)
+}
+
+func (dbconn *DBConn) MustRollbackToSavepoint(name string, whichConn ...int) {
+	err := dbconn.RollbackToSavepoint(name, whichConn...)
+	gplog.FatalOnError(err)
+}
+
+func (dbconn *DBConn) RollbackToSavepoint(name string, whichConn ...int) error {
+	return dbconn.execInTransaction("rollback to savepoint", "ROLLBACK TO SAVEPOINT "+quoteIdentifier(name), whichConn...)
+}
+
+func (dbconn *DBConn) MustReleaseSavepoint(name string, whichConn ...int) {
+	err := dbconn.ReleaseSavepoint(name, whichConn...)
+	gplog.FatalOnError(err)
+}
+
+func (dbconn *DBConn) ReleaseSavepoint(name string, whichConn ...int) error {
+	return dbconn.execInTransaction("release savepoint", "RELEASE SAVEPOINT "+quoteIdentifier(name), whichConn...)
+}
+
+func (dbconn *DBConn) execInTransaction(action string, statement string, whichConn ...int) error {
+	connNum := dbconn.ValidateConnNum(whichConn...)
+	if dbconn.Tx[connNum] == nil {
+		return errors.Errorf("Cannot %s; there is no transaction in progress", action)
+	}
+	_, err := dbconn.Exec(statement, connNum)
+	return err
+}
+
+/*
+ * Runs savepointFunc inside a savepoint in the transaction in progress on the
+ * given connection.  If savepointFunc returns an error or panics, everything it
+ * did is rolled back, leaving the rest of the transaction usable, and the error
+ * is returned or the panic continues.  The savepoint is released either way.
+ */
+func (dbconn *DBConn) WithSavepoint(connNum int, name string, savepointFunc func() error) (err error) {
+	connNum = dbconn.ValidateConnNum(connNum)
+	err = dbconn.Savepoint(name, connNum)
+	if err != nil {
+		return err
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			rollbackErr := dbconn.rollbackAndReleaseSavepoint(name, connNum)
+			if err != nil && rollbackErr != nil {
+				err = errors.Wrapf(rollbackErr, "Unable to roll back to savepoint %s after error %v", name, err)
+			}
+		}
+	}()
+	err = savepointFunc()
+	if err != nil {
+		return err
+	}
+	succeeded = true
+	return dbconn.ReleaseSavepoint(name, connNum)
+}
+
+func (dbconn *DBConn) rollbackAndReleaseSavepoint(name string, connNum int) error {
+	err := dbconn.RollbackToSavepoint(name, connNum)
+	if err != nil {
+		return err
+	}
+	return dbconn.ReleaseSavepoint(name, connNum)
+}
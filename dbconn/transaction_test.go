@@ -0,0 +1,297 @@
+package dbconn_test
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+
+	"github.com/greenplum-db/gp-common-go-libs/dbconn"
+	"github.com/greenplum-db/gp-common-go-libs/testhelper"
+	"github.com/jackc/pgx"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dbconn/transaction tests", func() {
+	fakeResult := testhelper.TestResult{Rows: 0}
+
+	Describe("DBConn.BeginWithOptions", func() {
+		It("begins a transaction with the given isolation level and access mode", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("SET TRANSACTION ISOLATION LEVEL READ COMMITTED, READ ONLY")).WillReturnResult(fakeResult)
+
+			err := connection.BeginWithOptions(dbconn.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(connection.Tx[0]).ToNot(BeNil())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("begins a repeatable read transaction on the given connection", func() {
+			connection, mock = testhelper.CreateAndConnectMockDB(2)
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ")).WillReturnResult(fakeResult)
+
+			err := connection.BeginWithOptions(dbconn.TxOptions{Isolation: sql.LevelRepeatableRead}, 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(connection.Tx[0]).To(BeNil())
+			Expect(connection.Tx[1]).ToNot(BeNil())
+		})
+		It("uses the server defaults if no options are given", func() {
+			mock.ExpectBegin()
+
+			err := connection.BeginWithOptions(dbconn.TxOptions{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("begins a deferrable transaction", func() {
+			testhelper.SetDBVersion(connection, "6.0.0")
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("SET TRANSACTION ISOLATION LEVEL SERIALIZABLE, READ ONLY, DEFERRABLE")).WillReturnResult(fakeResult)
+
+			err := connection.BeginWithOptions(dbconn.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true, Deferrable: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("returns an error for a deferrable transaction before GPDB 6", func() {
+			err := connection.BeginWithOptions(dbconn.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true, Deferrable: true})
+			Expect(err).To(MatchError("Deferrable transactions are not supported before GPDB 6"))
+			Expect(connection.Tx[0]).To(BeNil())
+		})
+		It("begins a deferrable transaction on Cloudberry", func() {
+			connection.Version, _ = dbconn.ParseVersion("PostgreSQL 14.4 (Apache Cloudberry 1.6.0 build 1)", "140004")
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("SET TRANSACTION READ ONLY, DEFERRABLE")).WillReturnResult(fakeResult)
+
+			Expect(connection.BeginWithOptions(dbconn.TxOptions{ReadOnly: true, Deferrable: true})).To(Succeed())
+		})
+		It("returns an error for a deferrable transaction before PostgreSQL 9.1", func() {
+			connection.Version, _ = dbconn.ParseVersion("PostgreSQL 9.0.23 on x86_64-pc-linux-gnu", "90023")
+			err := connection.BeginWithOptions(dbconn.TxOptions{ReadOnly: true, Deferrable: true})
+			Expect(err).To(MatchError("Deferrable transactions are not supported before PostgreSQL 9.1"))
+		})
+		It("returns an error for an unsupported isolation level", func() {
+			err := connection.BeginWithOptions(dbconn.TxOptions{Isolation: sql.LevelLinearizable})
+			Expect(err).To(MatchError("Isolation level Linearizable is not supported"))
+			Expect(connection.Tx[0]).To(BeNil())
+		})
+		It("returns an error if there is already a transaction in progress", func() {
+			ExpectBegin(mock)
+			connection.MustBegin()
+
+			err := connection.BeginWithOptions(dbconn.TxOptions{ReadOnly: true})
+			Expect(err).To(MatchError("Cannot begin transaction; there is already a transaction in progress"))
+		})
+	})
+	Describe("DBConn.Begin", func() {
+		It("begins a serializable transaction", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("SET TRANSACTION ISOLATION LEVEL SERIALIZABLE")).WillReturnResult(fakeResult)
+
+			err := connection.Begin()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+	Describe("DBConn.WithTransaction", func() {
+		It("commits the transaction if the function succeeds", func() {
+			ExpectBegin(mock)
+			mock.ExpectExec("INSERT (.*)").WillReturnResult(fakeResult)
+			mock.ExpectCommit()
+
+			err := connection.WithTransaction(0, func() error {
+				_, err := connection.Exec("INSERT INTO foo VALUES (1)")
+				return err
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(connection.Tx[0]).To(BeNil())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("rolls back the transaction and returns the error if the function fails", func() {
+			ExpectBegin(mock)
+			mock.ExpectExec("INSERT (.*)").WillReturnError(fmt.Errorf("duplicate key"))
+			mock.ExpectRollback()
+
+			err := connection.WithTransaction(0, func() error {
+				_, err := connection.Exec("INSERT INTO foo VALUES (1)")
+				return err
+			})
+			Expect(err).To(MatchError("duplicate key"))
+			Expect(connection.Tx[0]).To(BeNil())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("rolls back the transaction and panics again if the function panics", func() {
+			ExpectBegin(mock)
+			mock.ExpectRollback()
+
+			Expect(func() {
+				_ = connection.WithTransaction(0, func() error {
+					panic("oops")
+				})
+			}).To(Panic())
+			Expect(connection.Tx[0]).To(BeNil())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("does not retry a serialization failure", func() {
+			ExpectBegin(mock)
+			mock.ExpectRollback()
+
+			err := connection.WithTransaction(0, func() error {
+				return pgx.PgError{Code: "40001", Message: "could not serialize access"}
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("returns an error without rolling back if there is already a transaction in progress", func() {
+			ExpectBegin(mock)
+			connection.MustBegin()
+
+			err := connection.WithTransaction(0, func() error { return nil })
+			Expect(err).To(MatchError("Cannot begin transaction; there is already a transaction in progress"))
+			Expect(connection.Tx[0]).ToNot(BeNil())
+		})
+	})
+	Describe("DBConn.WithTransactionOptions", func() {
+		It("retries the transaction after a serialization failure", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("INSERT (.*)").WillReturnError(pgx.PgError{Code: "40001", Message: "could not serialize access"})
+			mock.ExpectRollback()
+			mock.ExpectBegin()
+			mock.ExpectExec("INSERT (.*)").WillReturnResult(fakeResult)
+			mock.ExpectCommit()
+
+			attempts := 0
+			err := connection.WithTransactionOptions(0, dbconn.TxOptions{}, 2, func() error {
+				attempts++
+				_, err := connection.Exec("INSERT INTO foo VALUES (1)")
+				return err
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(attempts).To(Equal(2))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("retries a serialization failure on commit", func() {
+			mock.ExpectBegin()
+			mock.ExpectCommit().WillReturnError(pgx.PgError{Code: "40001", Message: "could not serialize access"})
+			mock.ExpectBegin()
+			mock.ExpectCommit()
+
+			err := connection.WithTransactionOptions(0, dbconn.TxOptions{}, 1, func() error { return nil })
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("returns the serialization failure once out of retries", func() {
+			for i := 0; i < 2; i++ {
+				mock.ExpectBegin()
+				mock.ExpectRollback()
+			}
+
+			attempts := 0
+			err := connection.WithTransactionOptions(0, dbconn.TxOptions{}, 1, func() error {
+				attempts++
+				return pgx.PgError{Code: "40001", Message: "could not serialize access"}
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(attempts).To(Equal(2))
+		})
+		It("does not retry other errors", func() {
+			mock.ExpectBegin()
+			mock.ExpectRollback()
+
+			attempts := 0
+			err := connection.WithTransactionOptions(0, dbconn.TxOptions{}, 3, func() error {
+				attempts++
+				return pgx.PgError{Code: "23505", Message: "duplicate key"}
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(attempts).To(Equal(1))
+		})
+		It("rolls back if setting the transaction options fails", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec("SET TRANSACTION (.*)").WillReturnError(fmt.Errorf("invalid option"))
+			mock.ExpectRollback()
+
+			err := connection.WithTransactionOptions(0, dbconn.TxOptions{ReadOnly: true}, 0, func() error { return nil })
+			Expect(err).To(MatchError("invalid option"))
+			Expect(connection.Tx[0]).To(BeNil())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+	Describe("savepoints", func() {
+		BeforeEach(func() {
+			ExpectBegin(mock)
+			connection.MustBegin()
+		})
+		It("creates, rolls back to, and releases a savepoint", func() {
+			mock.ExpectExec(regexp.QuoteMeta(`SAVEPOINT "before_insert"`)).WillReturnResult(fakeResult)
+			mock.ExpectExec(regexp.QuoteMeta(`ROLLBACK TO SAVEPOINT "before_insert"`)).WillReturnResult(fakeResult)
+			mock.ExpectExec(regexp.QuoteMeta(`RELEASE SAVEPOINT "before_insert"`)).WillReturnResult(fakeResult)
+
+			Expect(connection.Savepoint("before_insert")).To(Succeed())
+			Expect(connection.RollbackToSavepoint("before_insert")).To(Succeed())
+			Expect(connection.ReleaseSavepoint("before_insert")).To(Succeed())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("quotes the savepoint name", func() {
+			mock.ExpectExec(regexp.QuoteMeta(`SAVEPOINT "Save""Point"`)).WillReturnResult(fakeResult)
+
+			Expect(connection.Savepoint(`Save"Point`)).To(Succeed())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("returns an error if there is no transaction in progress", func() {
+			connection, mock = testhelper.CreateAndConnectMockDB(1)
+			Expect(connection.Savepoint("sp")).To(MatchError("Cannot create savepoint; there is no transaction in progress"))
+			Expect(connection.RollbackToSavepoint("sp")).To(MatchError("Cannot rollback to savepoint; there is no transaction in progress"))
+			Expect(connection.ReleaseSavepoint("sp")).To(MatchError("Cannot release savepoint; there is no transaction in progress"))
+		})
+	})
+	Describe("DBConn.WithSavepoint", func() {
+		BeforeEach(func() {
+			ExpectBegin(mock)
+			connection.MustBegin()
+			mock.ExpectExec(regexp.QuoteMeta(`SAVEPOINT "sp"`)).WillReturnResult(fakeResult)
+		})
+		It("releases the savepoint if the function succeeds", func() {
+			mock.ExpectExec("INSERT (.*)").WillReturnResult(fakeResult)
+			mock.ExpectExec(regexp.QuoteMeta(`RELEASE SAVEPOINT "sp"`)).WillReturnResult(fakeResult)
+
+			err := connection.WithSavepoint(0, "sp", func() error {
+				_, err := connection.Exec("INSERT INTO foo VALUES (1)")
+				return err
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("rolls back to the savepoint and returns the error if the function fails", func() {
+			mock.ExpectExec("INSERT (.*)").WillReturnError(fmt.Errorf("duplicate key"))
+			mock.ExpectExec(regexp.QuoteMeta(`ROLLBACK TO SAVEPOINT "sp"`)).WillReturnResult(fakeResult)
+			mock.ExpectExec(regexp.QuoteMeta(`RELEASE SAVEPOINT "sp"`)).WillReturnResult(fakeResult)
+
+			err := connection.WithSavepoint(0, "sp", func() error {
+				_, err := connection.Exec("INSERT INTO foo VALUES (1)")
+				return err
+			})
+			Expect(err).To(MatchError("duplicate key"))
+			Expect(connection.Tx[0]).ToNot(BeNil())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("rolls back to the savepoint if the function panics", func() {
+			mock.ExpectExec(regexp.QuoteMeta(`ROLLBACK TO SAVEPOINT "sp"`)).WillReturnResult(fakeResult)
+			mock.ExpectExec(regexp.QuoteMeta(`RELEASE SAVEPOINT "sp"`)).WillReturnResult(fakeResult)
+
+			Expect(func() {
+				_ = connection.WithSavepoint(0, "sp", func() error {
+					panic("oops")
+				})
+			}).To(Panic())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+		It("reports an error rolling back to the savepoint", func() {
+			mock.ExpectExec(regexp.QuoteMeta(`ROLLBACK TO SAVEPOINT "sp"`)).WillReturnError(fmt.Errorf("connection lost"))
+
+			err := connection.WithSavepoint(0, "sp", func() error {
+				return fmt.Errorf("duplicate key")
+			})
+			Expect(err).To(MatchError("Unable to roll back to savepoint sp after error duplicate key: connection lost"))
+		})
+	})
+})
@@ -1,15 +1,45 @@
 package dbconn
 
 import (
+	"context"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/blang/semver"
+	"github.com/pkg/errors"
 )
 
+/*
+ * The database products that InitializeVersion can identify.  ProductOther is
+ * any other server derived from PostgreSQL, whose version() output does not
+ * start with "PostgreSQL"; its name and version are taken from that output as
+ * well as possible.
+ */
+type Product string
+
+const (
+	ProductGPDB       Product = "GPDB"
+	ProductCloudberry Product = "Cloudberry"
+	ProductPostgreSQL Product = "PostgreSQL"
+	ProductOther      Product = "Other"
+)
+
+/*
+ * VersionString and SemVer hold the version of the product itself, such as
+ * 6.20.3 for GPDB, which the Before, AtLeast, and Is functions compare against,
+ * while PostgresVersion holds the version of PostgreSQL it is based on, as
+ * given by server_version_num.  For plain PostgreSQL these are the same.
+ *
+ * Checks for GPDB features should use GPDBBefore and GPDBAtLeast instead, as
+ * other products number their versions differently.
+ */
 type GPDBVersion struct {
-	VersionString string
-	SemVer        semver.Version
+	VersionString   string
+	SemVer          semver.Version
+	Product         Product
+	ProductName     string
+	PostgresVersion semver.Version
 }
 
 /*
@@ -26,23 +56,116 @@ func NewVersion(versionStr string) GPDBVersion {
 	version := GPDBVersion{
 		VersionString: versionStr,
 		SemVer:        semver.MustParse(versionStr),
+		Product:       ProductGPDB,
+		ProductName:   "Greenplum Database",
 	}
 	return version
 }
 
 func InitializeVersion(dbconn *DBConn) (dbversion GPDBVersion, err error) {
-	err = dbconn.Get(&dbversion, "SELECT version() AS versionstring")
+	return initializeVersion(context.Background(), dbconn)
+}
+
+func initializeVersion(ctx context.Context, dbconn *DBConn) (dbversion GPDBVersion, err error) {
+	result := struct {
+		VersionString string `db:"versionstring"`
+		VersionNum    string `db:"versionnum"`
+	}{}
+	err = dbconn.GetContext(ctx, &result, "SELECT version() AS versionstring, current_setting('server_version_num') AS versionnum")
 	if err != nil {
 		return
 	}
-	versionStart := strings.Index(dbversion.VersionString, "(Greenplum Database ") + len("(Greenplum Database ")
-	versionEnd := strings.Index(dbversion.VersionString, ")")
-	dbversion.VersionString = dbversion.VersionString[versionStart:versionEnd]
-
-	pattern := regexp.MustCompile(`\d+\.\d+\.\d+`)
-	threeDigitVersion := pattern.FindStringSubmatch(dbversion.VersionString)[0]
-	dbversion.SemVer, err = semver.Make(threeDigitVersion)
-	return
+	return ParseVersion(result.VersionString, result.VersionNum)
+}
+
+var (
+	gpdbDerivativePattern = regexp.MustCompile(`\((Greenplum Database|Cloudberry Database|Apache Cloudberry) ([^)]*)\)`)
+	versionNumberPattern  = regexp.MustCompile(`\d+\.\d+(\.\d+)?`)
+	productNamePattern    = regexp.MustCompile(`^(\D*?)\s*v?\d`)
+)
+
+/*
+ * Identifies the product and versions of a server from the output of version()
+ * and the server_version_num setting, returning an error if either is not in a
+ * recognized format.  An empty serverVersionNum is accepted, for servers and
+ * tests that do not provide it, in which case PostgresVersion is only known
+ * for plain PostgreSQL.
+ */
+func ParseVersion(versionOutput string, serverVersionNum string) (dbversion GPDBVersion, err error) {
+	if serverVersionNum != "" {
+		dbversion.PostgresVersion, err = parseServerVersionNum(serverVersionNum)
+		if err != nil {
+			return GPDBVersion{}, err
+		}
+	}
+
+	if match := gpdbDerivativePattern.FindStringSubmatch(versionOutput); match != nil {
+		dbversion.ProductName = match[1]
+		dbversion.Product = ProductCloudberry
+		if match[1] == "Greenplum Database" {
+			dbversion.Product = ProductGPDB
+		}
+		dbversion.VersionString = match[2]
+	} else if strings.HasPrefix(versionOutput, "PostgreSQL ") {
+		fields := strings.Fields(versionOutput)
+		if len(fields) < 2 {
+			return GPDBVersion{}, errors.Errorf("Unrecognized database version string: %q", versionOutput)
+		}
+		dbversion.Product = ProductPostgreSQL
+		dbversion.ProductName = string(ProductPostgreSQL)
+		dbversion.VersionString = fields[1]
+		if serverVersionNum != "" {
+			dbversion.SemVer = dbversion.PostgresVersion
+			return dbversion, nil
+		}
+	} else if match := productNamePattern.FindStringSubmatch(versionOutput); match != nil && match[1] != "" {
+		dbversion.Product = ProductOther
+		dbversion.ProductName = match[1]
+		dbversion.VersionString = strings.Fields(versionOutput[len(match[1]):])[0]
+	} else {
+		return GPDBVersion{}, errors.Errorf("Unrecognized database version string: %q", versionOutput)
+	}
+
+	dbversion.SemVer, err = parseVersionNumber(dbversion.VersionString)
+	if err != nil {
+		return GPDBVersion{}, errors.Wrapf(err, "Unrecognized %s version in database version string %q", dbversion.ProductName, versionOutput)
+	}
+	if dbversion.Product == ProductPostgreSQL {
+		dbversion.PostgresVersion = dbversion.SemVer
+	}
+	return dbversion, nil
+}
+
+/*
+ * Takes the first version number in the string, adding a patch version of 0 if
+ * there is none, so "6.20.3 build commit:abc" gives 6.20.3 and "14.4" gives
+ * 14.4.0.
+ */
+func parseVersionNumber(versionStr string) (semver.Version, error) {
+	match := versionNumberPattern.FindStringSubmatch(versionStr)
+	if match == nil {
+		return semver.Version{}, errors.Errorf("No version number found in %q", versionStr)
+	}
+	if match[1] == "" {
+		return semver.Make(match[0] + ".0")
+	}
+	return semver.Make(match[0])
+}
+
+/*
+ * Before PostgreSQL 10, server_version_num holds two digits each for the major,
+ * minor, and patch versions, such as 90424 for 9.4.24; since then it holds the
+ * major version and four digits for the minor version, such as 140004 for 14.4.
+ */
+func parseServerVersionNum(serverVersionNum string) (semver.Version, error) {
+	versionNum, err := strconv.Atoi(serverVersionNum)
+	if err != nil || versionNum <= 0 {
+		return semver.Version{}, errors.Errorf("Unrecognized server_version_num: %q", serverVersionNum)
+	}
+	if versionNum >= 100000 {
+		return semver.Version{Major: uint64(versionNum / 10000), Minor: uint64(versionNum % 10000)}, nil
+	}
+	return semver.Version{Major: uint64(versionNum / 10000), Minor: uint64(versionNum / 100 % 100), Patch: uint64(versionNum % 100)}, nil
 }
 
 func StringToSemVerRange(versionStr string) semver.Range {
@@ -68,3 +191,35 @@ func (dbversion GPDBVersion) Is(targetVersion string) bool {
 	validRange := StringToSemVerRange("==" + targetVersion)
 	return validRange(dbversion.SemVer)
 }
+
+/*
+ * Cloudberry was forked from GPDB 7 and has its features, whatever its own
+ * version, while servers not derived from GPDB have no GPDB version at all.
+ * A GPDBVersion without a Product, such as one made in a test, is GPDB.
+ */
+var cloudberryGPDBVersion = semver.MustParse("7.0.0")
+
+func (dbversion GPDBVersion) gpdbVersion() (semver.Version, bool) {
+	switch dbversion.Product {
+	case ProductCloudberry:
+		return cloudberryGPDBVersion, true
+	case ProductPostgreSQL, ProductOther:
+		return semver.Version{}, false
+	}
+	return dbversion.SemVer, true
+}
+
+/*
+ * These compare the GPDB version whose features the server has, so that a
+ * Cloudberry server is treated as GPDB 7; both return false for a server not
+ * derived from GPDB, as it has neither the old nor the new GPDB behavior.
+ */
+func (dbversion GPDBVersion) GPDBBefore(targetVersion string) bool {
+	gpdbVersion, ok := dbversion.gpdbVersion()
+	return ok && StringToSemVerRange("<"+targetVersion)(gpdbVersion)
+}
+
+func (dbversion GPDBVersion) GPDBAtLeast(targetVersion string) bool {
+	gpdbVersion, ok := dbversion.gpdbVersion()
+	return ok && StringToSemVerRange(">="+targetVersion)(gpdbVersion)
+}
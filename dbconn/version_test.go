@@ -1,6 +1,7 @@
 package dbconn_test
 
 import (
+	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/blang/semver"
 	"github.com/greenplum-db/gp-common-go-libs/dbconn"
 
@@ -105,4 +106,108 @@ var _ = Describe("dbconn/version tests", func() {
 			Expect(result).To(BeFalse())
 		})
 	})
+	Describe("ParseVersion", func() {
+		It("parses a GPDB version string", func() {
+			version, err := dbconn.ParseVersion("PostgreSQL 9.4.24 (Greenplum Database 6.20.3 build commit:abc123) on x86_64-unknown-linux-gnu", "90424")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version.Product).To(Equal(dbconn.ProductGPDB))
+			Expect(version.ProductName).To(Equal("Greenplum Database"))
+			Expect(version.VersionString).To(Equal("6.20.3 build commit:abc123"))
+			Expect(version.SemVer).To(Equal(semver.MustParse("6.20.3")))
+			Expect(version.PostgresVersion).To(Equal(semver.MustParse("9.4.24")))
+		})
+		It("parses a GPDB development build version string", func() {
+			version, err := dbconn.ParseVersion("PostgreSQL 12.12 (Greenplum Database 7.0.0-beta.1+dev.45.gabc123 build dev) on x86_64-pc-linux-gnu", "120012")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version.SemVer).To(Equal(semver.MustParse("7.0.0")))
+			Expect(version.PostgresVersion).To(Equal(semver.MustParse("12.12.0")))
+		})
+		It("parses a Cloudberry version string", func() {
+			version, err := dbconn.ParseVersion("PostgreSQL 14.4 (Apache Cloudberry 1.6.0 build 1) on x86_64-pc-linux-gnu", "140004")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version.Product).To(Equal(dbconn.ProductCloudberry))
+			Expect(version.ProductName).To(Equal("Apache Cloudberry"))
+			Expect(version.SemVer).To(Equal(semver.MustParse("1.6.0")))
+			Expect(version.PostgresVersion).To(Equal(semver.MustParse("14.4.0")))
+		})
+		It("parses a PostgreSQL version string", func() {
+			version, err := dbconn.ParseVersion("PostgreSQL 16.1 (Debian 16.1-1.pgdg120+1) on x86_64-pc-linux-gnu, compiled by gcc", "160001")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version.Product).To(Equal(dbconn.ProductPostgreSQL))
+			Expect(version.VersionString).To(Equal("16.1"))
+			Expect(version.SemVer).To(Equal(semver.MustParse("16.1.0")))
+			Expect(version.PostgresVersion).To(Equal(semver.MustParse("16.1.0")))
+		})
+		It("uses server_version_num for a PostgreSQL development build", func() {
+			version, err := dbconn.ParseVersion("PostgreSQL 17devel on x86_64-pc-linux-gnu", "170000")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version.VersionString).To(Equal("17devel"))
+			Expect(version.SemVer).To(Equal(semver.MustParse("17.0.0")))
+		})
+		It("parses the version of another derivative", func() {
+			version, err := dbconn.ParseVersion("EnterpriseDB 9.6.2.7 on x86_64-pc-linux-gnu", "90602")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version.Product).To(Equal(dbconn.ProductOther))
+			Expect(version.ProductName).To(Equal("EnterpriseDB"))
+			Expect(version.SemVer).To(Equal(semver.MustParse("9.6.2")))
+			Expect(version.PostgresVersion).To(Equal(semver.MustParse("9.6.2")))
+		})
+		It("accepts a missing server_version_num", func() {
+			version, err := dbconn.ParseVersion("(Greenplum Database 5.1.0)", "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version.SemVer).To(Equal(semver.MustParse("5.1.0")))
+			Expect(version.PostgresVersion).To(Equal(semver.Version{}))
+		})
+		It("returns an error for a version string it does not recognize", func() {
+			_, err := dbconn.ParseVersion("some unexpected output", "90424")
+			Expect(err).To(MatchError(`Unrecognized database version string: "some unexpected output"`))
+		})
+		It("returns an error for a PostgreSQL version string without a version", func() {
+			_, err := dbconn.ParseVersion("PostgreSQL ", "")
+			Expect(err).To(MatchError(`Unrecognized database version string: "PostgreSQL "`))
+		})
+		It("returns an error for a GPDB version string without a version number", func() {
+			_, err := dbconn.ParseVersion("PostgreSQL 9.4.24 (Greenplum Database dev build)", "90424")
+			Expect(err).To(MatchError(`Unrecognized Greenplum Database version in database version string "PostgreSQL 9.4.24 (Greenplum Database dev build)": No version number found in "dev build"`))
+		})
+		It("returns an error for an invalid server_version_num", func() {
+			_, err := dbconn.ParseVersion("PostgreSQL 14.4 on x86_64-pc-linux-gnu", "fourteen")
+			Expect(err).To(MatchError(`Unrecognized server_version_num: "fourteen"`))
+		})
+	})
+	Describe("GPDBBefore and GPDBAtLeast", func() {
+		It("compare the GPDB version", func() {
+			version := dbconn.NewVersion("6.20.3")
+			Expect(version.GPDBBefore("7")).To(BeTrue())
+			Expect(version.GPDBAtLeast("6")).To(BeTrue())
+		})
+		It("treat Cloudberry as GPDB 7", func() {
+			version, err := dbconn.ParseVersion("PostgreSQL 14.4 (Apache Cloudberry 1.6.0 build 1)", "140004")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version.GPDBAtLeast("7")).To(BeTrue())
+			Expect(version.GPDBBefore("6")).To(BeFalse())
+		})
+		It("return false for PostgreSQL", func() {
+			version, err := dbconn.ParseVersion("PostgreSQL 9.1.24 on x86_64-pc-linux-gnu", "90124")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version.GPDBAtLeast("6.21.0")).To(BeFalse())
+			Expect(version.GPDBBefore("6")).To(BeFalse())
+		})
+	})
+	Describe("InitializeVersion", func() {
+		It("returns an error instead of panicking if the version is not recognized", func() {
+			mock.ExpectQuery("SELECT version()").WillReturnRows(sqlmock.NewRows([]string{"versionstring", "versionnum"}).AddRow("unexpected", "90424"))
+
+			_, err := dbconn.InitializeVersion(connection)
+			Expect(err).To(MatchError(`Unrecognized database version string: "unexpected"`))
+		})
+		It("identifies a PostgreSQL server", func() {
+			mock.ExpectQuery("SELECT version()").WillReturnRows(sqlmock.NewRows([]string{"versionstring", "versionnum"}).AddRow("PostgreSQL 14.4 on x86_64-pc-linux-gnu", "140004"))
+
+			version, err := dbconn.InitializeVersion(connection)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version.Product).To(Equal(dbconn.ProductPostgreSQL))
+			Expect(version.AtLeast("14")).To(BeTrue())
+		})
+	})
 })
@@ -12,7 +12,7 @@ require (
 	github.com/hashicorp/go-version v1.2.0 // indirect
 	github.com/hpcloud/tail v1.0.0 // indirect
 	github.com/jackc/fake v0.0.0-20150926172116-812a484cc733 // indirect
-	github.com/jackc/pgx v3.1.0+incompatible
+	github.com/jackc/pgx v3.6.2+incompatible
 	github.com/jmoiron/sqlx v0.0.0-20180614180643-0dae4fefe7c0
 	github.com/lib/pq v1.3.0 // indirect
 	github.com/mattn/go-sqlite3 v2.0.2+incompatible // indirect
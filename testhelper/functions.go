@@ -65,9 +65,14 @@ func CreateMockDBConn() (*dbconn.DBConn, sqlmock.Sqlmock) {
 	return connection, mock
 }
 
+/*
+ * The PostgreSQL version reported alongside the GPDB version is that of the
+ * release each GPDB major version is based on.
+ */
 func ExpectVersionQuery(mock sqlmock.Sqlmock, versionStr string) {
-	versionRow := sqlmock.NewRows([]string{"versionstring"}).AddRow(fmt.Sprintf("(Greenplum Database %s)", versionStr))
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT version() AS versionstring")).WillReturnRows(versionRow)
+	serverVersionNum := map[string]string{"4": "80215", "5": "80323", "6": "90424", "7": "120012"}[strings.Split(versionStr, ".")[0]]
+	versionRow := sqlmock.NewRows([]string{"versionstring", "versionnum"}).AddRow(fmt.Sprintf("(Greenplum Database %s)", versionStr), serverVersionNum)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version() AS versionstring, current_setting('server_version_num') AS versionnum")).WillReturnRows(versionRow)
 }
 
 func CreateAndConnectMockDB(numConns int) (*dbconn.DBConn, sqlmock.Sqlmock) {
@@ -41,6 +41,7 @@ type TestExecutor struct {
 	LocalCommands   []string
 	ClusterOutput   *cluster.RemoteOutput
 	ClusterCommands []map[int][]string
+	OutputFiles     []map[int]cluster.OutputFile
 	ErrorOnExecNum  int // Throw the specified error after this many executions of Execute[...]Command(); 0 means always return error
 	NumExecutions   int
 }
@@ -62,3 +63,8 @@ func (executor *TestExecutor) ExecuteClusterCommand(scope int, commandMap map[in
 	}
 	return nil
 }
+
+func (executor *TestExecutor) ExecuteClusterCommandToFiles(scope int, commandMap map[int][]string, outputFiles map[int]cluster.OutputFile) *cluster.RemoteOutput {
+	executor.OutputFiles = append(executor.OutputFiles, outputFiles)
+	return executor.ExecuteClusterCommand(scope, commandMap)
+}